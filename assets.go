@@ -0,0 +1,61 @@
+package taskbox
+
+import (
+	"embed"
+	"errors"
+	"io/fs"
+	"os"
+	"strings"
+)
+
+// templates, migrations and built static files baked into the binary, static/css is compiled from scss before go build
+//
+//go:embed templates migrations all:static css
+var embedded embed.FS
+
+// file trees the server reads at runtime
+type Assets struct {
+	Templates  fs.FS
+	Migrations fs.FS
+	Static     fs.FS
+}
+
+// assets compiled into the binary
+func EmbeddedAssets() Assets {
+	return Assets{
+		Templates:  sub("templates"),
+		Migrations: sub("migrations"),
+		Static:     prebuiltCSS{sub("static")},
+	}
+}
+
+// assets read from disk on every use, for editing templates and styles without rebuilding
+func DiskAssets(templatesDir, migrationsDir, staticDir string) Assets {
+	return Assets{
+		Templates:  os.DirFS(templatesDir),
+		Migrations: os.DirFS(migrationsDir),
+		Static:     os.DirFS(staticDir),
+	}
+}
+
+// static files, with the committed css/ standing in for static/css when a plain go build skipped build-assets
+type prebuiltCSS struct {
+	fs.FS
+}
+
+func (p prebuiltCSS) Open(name string) (fs.File, error) {
+	f, err := p.FS.Open(name)
+	if errors.Is(err, fs.ErrNotExist) && (name == "css" || strings.HasPrefix(name, "css/")) {
+		return embedded.Open(name)
+	}
+	return f, err
+}
+
+func sub(dir string) fs.FS {
+	fsys, err := fs.Sub(embedded, dir)
+	if err != nil {
+		// only fails for invalid names, and these are constants
+		panic(err)
+	}
+	return fsys
+}
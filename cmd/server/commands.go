@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"taskbox/internal/auth"
+	"taskbox/internal/config"
+	"taskbox/internal/scss"
+	"taskbox/internal/static"
+)
+
+// compressed css with source maps plus brotli and gzip copies for ci, prebuilt_css_dir when sass is missing
+func buildAssets(cfg *config.Config, args []string) error {
+	flags := flag.NewFlagSet("build-assets", flag.ContinueOnError)
+	out := flags.String("out", filepath.Join(cfg.StaticDir, "css"), "output directory")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		return errors.New("usage: taskbox build-assets [-out dir]")
+	}
+
+	compiler, err := scss.Find(cfg.SassBinary)
+	switch {
+	case err == nil:
+		slog.Info("using sass", "path", compiler.Sass, "version", compiler.Version)
+		compiler.Release = true
+		err = compiler.CompileAll(cfg.SCSSDir, *out)
+	case cfg.PrebuiltCSSDir != "":
+		slog.Warn("sass unavailable, using prebuilt css", "err", err, "dir", cfg.PrebuiltCSSDir)
+		err = scss.CopyPrebuilt(cfg.PrebuiltCSSDir, *out)
+	}
+	if err != nil {
+		return err
+	}
+
+	// served in place of the plain files to browsers that accept them
+	count, err := static.Precompress(*out)
+	if err != nil {
+		return err
+	}
+	slog.Info("precompressed assets", "dir", *out, "files", count)
+	return nil
+}
+
+// admin commands run instead of the server, e.g. `taskbox create-admin alice` or `taskbox reset-2fa alice`
+func runCommand(db *sql.DB, args []string) error {
+	switch args[0] {
+	case "unlock":
+		if len(args) != 2 {
+			return errors.New("usage: taskbox unlock <username>")
+		}
+		if err := auth.UnlockUser(db, args[1]); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return fmt.Errorf("no such user %q", args[1])
+			}
+			return err
+		}
+		fmt.Printf("unlocked %s\n", args[1])
+		return nil
+	case "create-admin":
+		if len(args) != 2 {
+			return errors.New("usage: taskbox create-admin <username> (password is read from stdin)")
+		}
+		fmt.Fprint(os.Stderr, "password: ")
+		password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		password = strings.TrimRight(password, "\r\n")
+		if password == "" {
+			if err != nil {
+				return fmt.Errorf("reading password: %w", err)
+			}
+			return errors.New("password required")
+		}
+		created, err := auth.CreateAdmin(db, args[1], password)
+		if err != nil {
+			return err
+		}
+		if created {
+			fmt.Printf("created admin %s\n", args[1])
+		} else {
+			fmt.Printf("%s is now an admin (password unchanged)\n", args[1])
+		}
+		return nil
+	case "reset-2fa":
+		if len(args) != 2 {
+			return errors.New("usage: taskbox reset-2fa <username>")
+		}
+		if err := auth.ResetTwoFactor(db, args[1]); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return fmt.Errorf("no such user %q", args[1])
+			}
+			return err
+		}
+		fmt.Printf("two-factor authentication removed for %s\n", args[1])
+		return nil
+	default:
+		return fmt.Errorf("unknown command %q (available: build-assets, create-admin, unlock, reset-2fa)", args[0])
+	}
+}
@@ -1,65 +1,320 @@
 package main
 
 import (
-	"database/sql"
+	"context"
+	"errors"
+	"flag"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"taskbox"
+	"taskbox/internal/auth"
+	"taskbox/internal/config"
+	"taskbox/internal/csrf"
 	"taskbox/internal/database"
+	"taskbox/internal/events"
 	"taskbox/internal/handlers"
+	"taskbox/internal/logging"
+	"taskbox/internal/mailer"
+	"taskbox/internal/mailin"
+	"taskbox/internal/metrics"
+	"taskbox/internal/ratelimit"
 	"taskbox/internal/scss"
-
-	_ "github.com/mattn/go-sqlite3"
+	"taskbox/internal/sso"
+	"taskbox/internal/webhooks"
+	"time"
 )
 
 func main() {
-	// check if in dev mode
-	devMode := os.Getenv("DEV_MODE") == "true"
+	// defaults, then config file, environment and flags
+	cfg, args, err := config.Load(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatal("invalid configuration:\n", err)
+	}
+
+	logger, err := logging.Setup(os.Stderr, cfg.LogFormat, cfg.LogLevel)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// asset builds for ci don't need the database
+	if len(args) > 0 && args[0] == "build-assets" {
+		if err := buildAssets(cfg, args[1:]); err != nil {
+			fatal("build-assets failed", err)
+		}
+		return
+	}
 
 	// initialize database
-	db, err := sql.Open("sqlite3", "./taskbox.db")
+	db, err := database.Open(cfg.DatabasePath)
 	if err != nil {
-		log.Fatal("failed to open database:", err)
+		fatal("failed to open database", err)
 	}
 	defer db.Close()
 
+	// templates, migrations and static files from the binary, or from disk while developing
+	assets := taskbox.EmbeddedAssets()
+	if cfg.AssetsFromDisk {
+		assets = taskbox.DiskAssets(cfg.TemplatesDir, cfg.MigrationsDir, cfg.StaticDir)
+	}
+	// dev mode reloads templates, so they always come from templates_dir
+	if cfg.DevMode {
+		assets.Templates = os.DirFS(cfg.TemplatesDir)
+	}
+
 	// run migrations
-	if err := database.RunMigrations(db); err != nil {
-		log.Fatal("failed to run migrations:", err)
+	if err := database.RunMigrations(db, assets.Migrations); err != nil {
+		fatal("failed to run migrations", err)
+	}
+
+	// auth policy, also used by the admin commands
+	auth.IdleTimeout = time.Duration(cfg.SessionIdleHours) * time.Hour
+	auth.AbsoluteTimeout = time.Duration(cfg.SessionMaxHours) * time.Hour
+	auth.MaxFailedLogins = cfg.LoginMaxFailures
+	auth.LockoutDuration = time.Duration(cfg.LoginLockoutMinutes) * time.Minute
+	auth.MinPasswordLength = cfg.PasswordMinLength
+	auth.Argon2.Memory = uint32(cfg.Argon2MemoryKB)
+	auth.Argon2.Time = uint32(cfg.Argon2Time)
+	auth.Argon2.Threads = uint8(cfg.Argon2Threads)
+
+	// admin commands exit without starting the server
+	if len(args) > 0 {
+		if err := runCommand(db, args); err != nil {
+			fatal("command failed", err)
+		}
+		return
+	}
+
+	slog.Info("effective configuration", "config", cfg)
+
+	// background workers run until SIGINT or SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	var workers sync.WaitGroup
+	background := func(run func()) {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			run()
+		}()
+	}
+
+	// expired sessions are removed in the background
+	background(func() { auth.SweepSessions(ctx, db, time.Hour) })
+
+	// webhook deliveries are sent in the background
+	hooks := webhooks.NewDispatcher(db)
+	background(func() { hooks.Run(ctx) })
+
+	// live board updates over server-sent events
+	hub := events.NewHub()
+
+	// outgoing mail for password resets, logged in dev mode and off when unconfigured
+	var mail mailer.Mailer
+	if cfg.MailSMTPAddr != "" {
+		mail = mailer.SMTPMailer{
+			Addr:     cfg.MailSMTPAddr,
+			From:     cfg.MailFrom,
+			Username: cfg.MailUsername,
+			Password: cfg.MailPassword,
+		}
+	} else if cfg.DevMode {
+		mail = mailer.LogMailer{}
+	}
+
+	// optional openid connect single sign-on
+	var provider *sso.Provider
+	if cfg.OIDCIssuer != "" {
+		provider, err = sso.New(ctx, sso.Config{
+			Issuer:       cfg.OIDCIssuer,
+			ClientID:     cfg.OIDCClientID,
+			ClientSecret: cfg.OIDCClientSecret,
+			RedirectURL:  cfg.RedirectURL(),
+			Name:         cfg.OIDCName,
+		})
+		if err != nil {
+			fatal("failed to set up single sign-on", err)
+		}
+		slog.Info("single sign-on enabled", "issuer", cfg.OIDCIssuer)
 	}
 
 	// setup handlers
 	mux := http.NewServeMux()
-	handlers := handlers.New(db, devMode)
+	handlers := handlers.New(db, cfg, assets, hooks, hub, mail, provider)
 
 	// static files
-	fs := http.FileServer(http.Dir("./static"))
-	mux.Handle("/static/", http.StripPrefix("/static/", fs))
+	mux.Handle("/static/", handlers.Static())
+
+	// prometheus scrapes, on their own listener or behind a token
+	metrics.RegisterDB(db)
+	var metricsServer *http.Server
+	switch {
+	case cfg.MetricsAddr != "":
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle("/metrics", metrics.Handler(cfg.MetricsToken))
+		metricsServer = &http.Server{
+			Addr:              cfg.MetricsAddr,
+			Handler:           metricsMux,
+			ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+			WriteTimeout:      cfg.WriteTimeout,
+			ErrorLog:          slog.NewLogLogger(logger.Handler(), slog.LevelWarn),
+		}
+		go func() {
+			if err := metricsServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				slog.Error("metrics listener failed", "err", err)
+			}
+		}()
+		slog.Info("metrics listener started", "addr", cfg.MetricsAddr)
+	case cfg.MetricsToken != "":
+		mux.Handle("/metrics", metrics.Handler(cfg.MetricsToken))
+	default:
+		slog.Info("metrics disabled, set metrics_addr or metrics_token to enable")
+	}
+
+	// liveness and readiness probes, /health is kept for dev mode reload
+	mux.HandleFunc("/healthz", handlers.Healthz)
+	mux.HandleFunc("/health", handlers.Healthz)
+	mux.HandleFunc("/readyz", handlers.Readyz)
 
-	// health check for dev mode reload
-	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-	})
+	// generous per-address cap on the task api
+	api := ratelimit.New(600, time.Minute, time.Second, time.Minute)
 
 	// routes
 	mux.HandleFunc("/", handlers.Index)
 	mux.HandleFunc("/register", handlers.Register)
 	mux.HandleFunc("/login", handlers.Login)
+	mux.HandleFunc("/login/2fa", handlers.LoginTwoFactor)
+	mux.HandleFunc("/auth/oidc/", handlers.SSO)
 	mux.HandleFunc("/logout", handlers.Logout)
-	mux.HandleFunc("/tasks", handlers.Tasks)
-	mux.HandleFunc("/tasks/", handlers.TaskDetail)
-	mux.HandleFunc("/comments/", handlers.Comments)
+	mux.HandleFunc("/forgot", handlers.Forgot)
+	mux.HandleFunc("/reset", handlers.Reset)
+	mux.HandleFunc("/settings", handlers.Settings)
+	mux.HandleFunc("/settings/", handlers.Settings)
+	mux.Handle("/tasks", api.Middleware(auth.ClientIP, http.HandlerFunc(handlers.Tasks)))
+	mux.Handle("/tasks/", api.Middleware(auth.ClientIP, http.HandlerFunc(handlers.TaskDetail)))
+	mux.Handle("/comments/", api.Middleware(auth.ClientIP, http.HandlerFunc(handlers.Comments)))
+	mux.HandleFunc("/attachments/", handlers.Attachment)
+	mux.HandleFunc("/email", handlers.Email)
+	mux.HandleFunc("/email/", handlers.Email)
+	mux.HandleFunc("/webhooks", handlers.Webhooks)
+	mux.HandleFunc("/webhooks/", handlers.Webhooks)
+	mux.HandleFunc("/events", handlers.Events)
+	mux.HandleFunc("/dev/reload", handlers.DevReload)
+	mux.HandleFunc("/invites", handlers.Invites)
+	mux.HandleFunc("/invites/", handlers.Invites)
+	mux.HandleFunc("/admin", handlers.Admin)
+	mux.HandleFunc("/admin/", handlers.Admin)
+	mux.HandleFunc("/sessions", handlers.Sessions)
+	mux.HandleFunc("/sessions/", handlers.Sessions)
+	mux.HandleFunc("/calendar", handlers.Calendar)
+	mux.HandleFunc("/calendar/", handlers.Calendar)
+	mux.HandleFunc("/cal/", handlers.CalendarFeed)
+	mux.HandleFunc("/dav/", handlers.CalDAV)
+	mux.Handle("/.well-known/caldav", http.RedirectHandler("/dav/", http.StatusMovedPermanently))
+
+	// recompile scss when serving from disk, or copy the prebuilt css without sass; embedded css is built with the binary
+	if cfg.AssetsFromDisk {
+		cssDir := filepath.Join(cfg.StaticDir, "css")
+		compiler, err := scss.Find(cfg.SassBinary)
+		switch {
+		case err == nil:
+			slog.Info("using sass", "path", compiler.Sass, "version", compiler.Version)
+			background(func() { scss.Watch(ctx, compiler, cfg.SCSSDir, cssDir) })
+			slog.Info("scss watcher started", "dir", cfg.SCSSDir)
+		case cfg.PrebuiltCSSDir != "":
+			slog.Warn("sass unavailable, using prebuilt css", "err", err, "dir", cfg.PrebuiltCSSDir)
+			if err := scss.CopyPrebuilt(cfg.PrebuiltCSSDir, cssDir); err != nil {
+				slog.Error("copying prebuilt css failed", "err", err)
+			}
+		default:
+			slog.Error("sass unavailable, stylesheets will not be built", "err", err)
+		}
+	} else {
+		slog.Info("serving embedded assets")
+	}
+
+	var smtp *mailin.Server
+	if cfg.SMTPAddr != "" {
+		smtp = mailin.NewServer(db, hooks, handlers, cfg.SMTPDomain, cfg.SMTPMaxBytes)
+		go func() {
+			if err := smtp.ListenAndServe(cfg.SMTPAddr); err != nil {
+				slog.Error("smtp listener failed", "err", err)
+			}
+		}()
+		slog.Info("smtp listener started", "addr", cfg.SMTPAddr, "domain", cfg.SMTPDomain)
+	}
+
+	if cfg.DevMode {
+		slog.Info("running in dev mode, browser auto-reload enabled")
+	}
 
-	// start scss watcher in background
-	go scss.Watch("./scss", "./static/css")
-	log.Println("scss watcher started")
+	// re-parse templates on save
+	if cfg.DevMode {
+		background(func() { handlers.WatchTemplates(ctx, cfg.TemplatesDir) })
+		slog.Info("template watcher started", "dir", cfg.TemplatesDir)
+	}
+
+	server := &http.Server{
+		Addr:              cfg.Addr,
+		Handler:           logging.Middleware(metrics.Middleware(mux, csrf.Protect(mux))),
+		ErrorLog:          slog.NewLogLogger(logger.Handler(), slog.LevelWarn),
+		ReadTimeout:       cfg.ReadTimeout,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+		MaxHeaderBytes:    cfg.MaxHeaderBytes,
+	}
 
-	if devMode {
-		log.Println("running in dev mode - browser auto-reload enabled")
+	slog.Info("server starting", "addr", cfg.Addr)
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serveErr:
+		fatal("server failed", err)
+	case <-ctx.Done():
 	}
+	// a second signal kills the process without waiting
+	stop()
+
+	slog.Info("shutting down, draining requests", "timeout", cfg.ShutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
 
-	log.Println("server starting on :1234")
-	if err := http.ListenAndServe(":1234", mux); err != nil {
-		log.Fatal("server failed:", err)
+	// live streams never finish on their own
+	hub.Close()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Error("http shutdown failed", "err", err)
+	}
+	if metricsServer != nil {
+		metricsServer.Shutdown(shutdownCtx)
 	}
+	if smtp != nil {
+		if err := smtp.Shutdown(shutdownCtx); err != nil {
+			slog.Error("smtp shutdown failed", "err", err)
+		}
+	}
+	workers.Wait()
+	// events from drained requests, delivered after the next start
+	hooks.Flush()
+
+	if err := db.Close(); err != nil {
+		slog.Error("closing database failed", "err", err)
+	}
+	slog.Info("shutdown complete")
+}
+
+func fatal(msg string, err error) {
+	slog.Error(msg, "err", err)
+	os.Exit(1)
 }
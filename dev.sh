@@ -8,7 +8,7 @@ echo ""
 
 # initial build and start
 go build -o taskbox ./cmd/server
-./taskbox &
+./taskbox -assets-from-disk &
 PID=$!
 
 # watch for changes
@@ -19,7 +19,7 @@ while true; do
 		echo "changes detected, rebuilding..."
 		pkill -P '$PID' taskbox 2>/dev/null
 		pkill taskbox 2>/dev/null
-		go build -o taskbox ./cmd/server && ./taskbox &
+		go build -o taskbox ./cmd/server && ./taskbox -assets-from-disk &
 		echo "server restarted"
 	' 2>/dev/null
 	
@@ -39,7 +39,7 @@ while true; do
 				echo ""
 				echo "changes detected, rebuilding..."
 				pkill taskbox 2>/dev/null
-				go build -o taskbox ./cmd/server && ./taskbox &
+				go build -o taskbox ./cmd/server && ./taskbox -assets-from-disk &
 				PID=$!
 				echo "server restarted"
 				LAST_CHANGE=$CURRENT_CHANGE
@@ -0,0 +1,115 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+)
+
+var ErrDisabled = errors.New("account disabled")
+
+// create an administrator, or promote the user if the name is taken
+func CreateAdmin(db *sql.DB, username, password string) (created bool, err error) {
+	var id int
+	err = db.QueryRow("SELECT id FROM users WHERE username = ?", username).Scan(&id)
+	if err == sql.ErrNoRows {
+		if err := ValidateUsername(username); err != nil {
+			return false, err
+		}
+		if err := CheckPasswordPolicy(password, username); err != nil {
+			return false, err
+		}
+		user, err := CreateUser(db, username, password)
+		if err != nil {
+			return false, err
+		}
+		id, created = user.ID, true
+	} else if err != nil {
+		return false, err
+	}
+
+	_, err = db.Exec("UPDATE users SET is_admin = 1, disabled_at = NULL WHERE id = ?", id)
+	return created, err
+}
+
+// block or allow sign-in; disabling also ends every session
+func SetDisabled(db *sql.DB, userID int, disabled bool) error {
+	if !disabled {
+		_, err := db.Exec("UPDATE users SET disabled_at = NULL WHERE id = ?", userID)
+		return err
+	}
+
+	if _, err := db.Exec("UPDATE users SET disabled_at = CURRENT_TIMESTAMP WHERE id = ?", userID); err != nil {
+		return err
+	}
+	_, err := db.Exec("DELETE FROM sessions WHERE user_id = ?", userID)
+	return err
+}
+
+// whether an account has been disabled by an administrator
+func IsDisabled(db *sql.DB, userID int) bool {
+	var disabled bool
+	db.QueryRow("SELECT disabled_at IS NOT NULL FROM users WHERE id = ?", userID).Scan(&disabled)
+	return disabled
+}
+
+// replace the password with a random one handed over out of band, clearing sessions and lockout
+func SetTemporaryPassword(db *sql.DB, userID int) (string, error) {
+	password, err := GenerateToken()
+	if err != nil {
+		return "", err
+	}
+	password = password[:16]
+
+	hash, err := HashPassword(password)
+	if err != nil {
+		return "", err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("UPDATE users SET password_hash = ?, failed_logins = 0, locked_until = NULL WHERE id = ?", hash, userID)
+	if err != nil {
+		return "", err
+	}
+	if _, err := tx.Exec("DELETE FROM sessions WHERE user_id = ?", userID); err != nil {
+		return "", err
+	}
+	return password, tx.Commit()
+}
+
+// remove a user and everything they own table by table, sqlite doesn't enforce the foreign keys
+func DeleteUser(db *sql.DB, userID int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	statements := []string{
+		"DELETE FROM attachments WHERE task_id IN (SELECT id FROM tasks WHERE user_id = ?)",
+		"DELETE FROM comments WHERE task_id IN (SELECT id FROM tasks WHERE user_id = ?)",
+		"DELETE FROM comments WHERE user_id = ?",
+		"DELETE FROM tasks WHERE user_id = ?",
+		"DELETE FROM webhook_deliveries WHERE webhook_id IN (SELECT id FROM webhooks WHERE user_id = ?)",
+		"DELETE FROM webhooks WHERE user_id = ?",
+		"DELETE FROM inbox_senders WHERE user_id = ?",
+		"DELETE FROM sessions WHERE user_id = ?",
+		"DELETE FROM password_resets WHERE user_id = ?",
+		"DELETE FROM recovery_codes WHERE user_id = ?",
+		"DELETE FROM user_identities WHERE user_id = ?",
+		"DELETE FROM login_attempts WHERE user_id = ?",
+		"DELETE FROM invites WHERE created_by = ?",
+		"DELETE FROM users WHERE id = ?",
+	}
+	for _, stmt := range statements {
+		if _, err := tx.Exec(stmt, userID); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
@@ -4,26 +4,15 @@ import (
 	"crypto/rand"
 	"database/sql"
 	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log/slog"
 	"net/http"
 	"taskbox/internal/models"
-
-	"golang.org/x/crypto/bcrypt"
 )
 
 const sessionCookie = "taskbox_session"
 
-// hash password using bcrypt
-func HashPassword(password string) (string, error) {
-	bytes, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-	return string(bytes), err
-}
-
-// check password against hash
-func CheckPassword(password, hash string) bool {
-	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
-	return err == nil
-}
-
 // generate random session token
 func GenerateToken() (string, error) {
 	b := make([]byte, 32)
@@ -65,28 +54,51 @@ func AuthenticateUser(db *sql.DB, username, password string) (*models.User, erro
 		username,
 	).Scan(&user.ID, &user.Username, &user.PasswordHash)
 
+	if errors.Is(err, sql.ErrNoRows) {
+		checkDummyPassword(password)
+	}
 	if err != nil {
 		return nil, err
 	}
 
+	// refused before the password is checked, so guesses during a lockout learn nothing
+	if LockedFor(db, username) > 0 {
+		return nil, ErrLocked
+	}
+
 	if !CheckPassword(password, user.PasswordHash) {
 		return nil, sql.ErrNoRows
 	}
 
+	// only reported to someone who knows the password
+	if IsDisabled(db, user.ID) {
+		return nil, ErrDisabled
+	}
+
+	// move bcrypt and outdated argon2 hashes to the current settings
+	if NeedsRehash(user.PasswordHash) {
+		if hash, err := HashPassword(password); err == nil {
+			if _, err := db.Exec("UPDATE users SET password_hash = ? WHERE id = ?", hash, user.ID); err != nil {
+				slog.Error("password rehash failed", "user_id", user.ID, "err", err)
+			}
+			user.PasswordHash = hash
+		}
+	}
+
 	return &user, nil
 }
 
 // create session
-func CreateSession(db *sql.DB, userID int) (string, error) {
+func CreateSession(db *sql.DB, userID int, ip, userAgent string) (string, error) {
 	token, err := GenerateToken()
 	if err != nil {
 		return "", err
 	}
 
-	_, err = db.Exec(
-		"INSERT INTO sessions (user_id, token) VALUES (?, ?)",
-		userID, token,
-	)
+	_, err = db.Exec(`
+		INSERT INTO sessions (user_id, token, ip, user_agent, last_seen_at, expires_at)
+		VALUES (?, ?, ?, ?, CURRENT_TIMESTAMP, datetime('now', '+' || ? || ' seconds'))
+	`, userID, token, ip, userAgent, int(AbsoluteTimeout.Seconds()))
 	if err != nil {
 		return "", err
 	}
@@ -94,15 +106,19 @@ func CreateSession(db *sql.DB, userID int) (string, error) {
 	return token, nil
 }
 
-// get user from session token
+// get user from session token, ignoring idle or expired sessions
 func GetUserFromSession(db *sql.DB, token string) (*models.User, error) {
 	var user models.User
 	err := db.QueryRow(`
-		SELECT u.id, u.username, u.password_hash 
+		SELECT u.id, u.username, COALESCE(u.email, ''), u.password_hash, u.is_admin
 		FROM users u
 		JOIN sessions s ON s.user_id = u.id
 		WHERE s.token = ?
-	`, token).Scan(&user.ID, &user.Username, &user.PasswordHash)
+			AND s.expires_at > CURRENT_TIMESTAMP
+			AND s.last_seen_at > datetime('now', '-' || ? || ' seconds')
+			AND s.pending_2fa = 0
+			AND u.disabled_at IS NULL
+	`, token, int(IdleTimeout.Seconds())).Scan(&user.ID, &user.Username, &user.Email, &user.PasswordHash, &user.IsAdmin)
 
 	if err != nil {
 		return nil, err
@@ -123,7 +139,7 @@ func SetSessionCookie(w http.ResponseWriter, token string) {
 		Name:     sessionCookie,
 		Value:    token,
 		Path:     "/",
-		MaxAge:   0, // session cookie (indefinite)
+		MaxAge:   int(AbsoluteTimeout.Seconds()),
 		HttpOnly: true,
 		SameSite: http.SameSiteLaxMode,
 	})
@@ -148,3 +164,75 @@ func ClearSessionCookie(w http.ResponseWriter) {
 		HttpOnly: true,
 	})
 }
+
+// get calendar feed token, creating one on first use
+func GetCalendarToken(db *sql.DB, userID int) (string, error) {
+	var token sql.NullString
+	err := db.QueryRow("SELECT calendar_token FROM users WHERE id = ?", userID).Scan(&token)
+	if err != nil {
+		return "", err
+	}
+	if token.Valid && token.String != "" {
+		return token.String, nil
+	}
+	return RegenerateCalendarToken(db, userID)
+}
+
+// replace calendar feed token, invalidating the old feed url
+func RegenerateCalendarToken(db *sql.DB, userID int) (string, error) {
+	token, err := GenerateToken()
+	if err != nil {
+		return "", err
+	}
+
+	_, err = db.Exec("UPDATE users SET calendar_token = ? WHERE id = ?", token, userID)
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// get user from calendar feed token
+func GetUserFromCalendarToken(db *sql.DB, token string) (*models.User, error) {
+	var user models.User
+	err := db.QueryRow(
+		"SELECT id, username, password_hash FROM users WHERE calendar_token = ?",
+		token,
+	).Scan(&user.ID, &user.Username, &user.PasswordHash)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+// get inbox email token, creating one on first use
+func GetInboxToken(db *sql.DB, userID int) (string, error) {
+	var token sql.NullString
+	err := db.QueryRow("SELECT inbox_token FROM users WHERE id = ?", userID).Scan(&token)
+	if err != nil {
+		return "", err
+	}
+	if token.Valid && token.String != "" {
+		return token.String, nil
+	}
+	return RegenerateInboxToken(db, userID)
+}
+
+// replace inbox email token, lowercase hex since mail hosts may fold case
+func RegenerateInboxToken(db *sql.DB, userID int) (string, error) {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+
+	_, err := db.Exec("UPDATE users SET inbox_token = ? WHERE id = ?", token, userID)
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
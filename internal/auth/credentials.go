@@ -0,0 +1,79 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"sync"
+	"taskbox/internal/models"
+	"time"
+)
+
+// recently verified passwords, so clients sending basic auth with every request skip argon2
+type CredentialCache struct {
+	TTL time.Duration
+
+	mu      sync.Mutex
+	key     []byte
+	entries map[string]credential
+}
+
+type credential struct {
+	mac     []byte
+	hash    string
+	expires time.Time
+}
+
+func NewCredentialCache(ttl time.Duration) *CredentialCache {
+	// per-process key, the cache never holds anything usable outside this process
+	key := make([]byte, 32)
+	rand.Read(key)
+	return &CredentialCache{TTL: ttl, key: key, entries: map[string]credential{}}
+}
+
+// AuthenticateUser, answered from the cache while the stored hash is unchanged; lockout and disabling still apply
+func (c *CredentialCache) Authenticate(db *sql.DB, username, password string) (*models.User, error) {
+	mac := c.mac(username, password)
+
+	c.mu.Lock()
+	cached, ok := c.entries[username]
+	c.mu.Unlock()
+
+	if ok && time.Now().Before(cached.expires) && hmac.Equal(cached.mac, mac) {
+		var user models.User
+		err := db.QueryRow(
+			"SELECT id, username, password_hash FROM users WHERE username = ?",
+			username,
+		).Scan(&user.ID, &user.Username, &user.PasswordHash)
+		// a changed password or a deleted account falls through to the full check
+		if err == nil && user.PasswordHash == cached.hash {
+			if LockedFor(db, username) > 0 {
+				return nil, ErrLocked
+			}
+			if IsDisabled(db, user.ID) {
+				return nil, ErrDisabled
+			}
+			return &user, nil
+		}
+	}
+
+	user, err := AuthenticateUser(db, username, password)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err != nil {
+		delete(c.entries, username)
+		return nil, err
+	}
+	c.entries[username] = credential{mac: mac, hash: user.PasswordHash, expires: time.Now().Add(c.TTL)}
+	return user, nil
+}
+
+func (c *CredentialCache) mac(username, password string) []byte {
+	m := hmac.New(sha256.New, c.key)
+	m.Write([]byte(username))
+	m.Write([]byte{0})
+	m.Write([]byte(password))
+	return m.Sum(nil)
+}
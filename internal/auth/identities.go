@@ -0,0 +1,201 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"taskbox/internal/models"
+)
+
+var (
+	ErrIdentityTaken = errors.New("identity is linked to another account")
+	ErrLastLogin     = errors.New("cannot remove the only way to sign in")
+)
+
+// local account linked to an external identity
+func GetUserByIdentity(db *sql.DB, issuer, subject string) (*models.User, error) {
+	var user models.User
+	err := db.QueryRow(`
+		SELECT u.id, u.username, COALESCE(u.email, '')
+		FROM users u
+		JOIN user_identities i ON i.user_id = u.id
+		WHERE i.issuer = ? AND i.subject = ?
+	`, issuer, subject).Scan(&user.ID, &user.Username, &user.Email)
+	if err != nil {
+		return nil, err
+	}
+
+	db.Exec(
+		"UPDATE user_identities SET last_login_at = CURRENT_TIMESTAMP WHERE issuer = ? AND subject = ?",
+		issuer, subject,
+	)
+	return &user, nil
+}
+
+// attach an external identity to a local account
+func LinkIdentity(db *sql.DB, userID int, issuer, subject, email string) error {
+	var owner int
+	err := db.QueryRow(
+		"SELECT user_id FROM user_identities WHERE issuer = ? AND subject = ?",
+		issuer, subject,
+	).Scan(&owner)
+	if err == nil {
+		if owner != userID {
+			return ErrIdentityTaken
+		}
+		return nil
+	}
+	if err != sql.ErrNoRows {
+		return err
+	}
+
+	_, err = db.Exec(
+		"INSERT INTO user_identities (user_id, issuer, subject, email, last_login_at) VALUES (?, ?, ?, ?, CURRENT_TIMESTAMP)",
+		userID, issuer, subject, email,
+	)
+	return err
+}
+
+// create a passwordless account for a first sso login, spending an invite use when given
+func ProvisionUser(db *sql.DB, username, email, invite string) (*models.User, error) {
+	base := provisionedUsername(username)
+
+	var emailValue interface{}
+	if email != "" {
+		// keep the address only if no other account has it
+		var taken bool
+		db.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE email = ?)", strings.ToLower(email)).Scan(&taken)
+		if !taken {
+			emailValue = strings.ToLower(email)
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var inviteID interface{}
+	if invite != "" {
+		id, err := useInvite(tx, invite)
+		if err != nil {
+			return nil, err
+		}
+		inviteID = id
+	}
+
+	for n := 1; n <= 100; n++ {
+		candidate := base
+		if n > 1 {
+			candidate = fmt.Sprintf("%s%d", base, n)
+		}
+
+		// an empty hash never matches, so the account has no usable password
+		result, err := tx.Exec(
+			"INSERT OR IGNORE INTO users (username, password_hash, email, invite_id) VALUES (?, '', ?, ?)",
+			candidate, emailValue, inviteID,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if rows, _ := result.RowsAffected(); rows == 0 {
+			continue
+		}
+		if err := tx.Commit(); err != nil {
+			return nil, err
+		}
+
+		id, _ := result.LastInsertId()
+		user := &models.User{ID: int(id), Username: candidate}
+		if emailValue != nil {
+			user.Email = emailValue.(string)
+		}
+		return user, nil
+	}
+
+	return nil, fmt.Errorf("no free username for %q", base)
+}
+
+// the provider's name if valid, otherwise its allowed characters, leaving room for a suffix
+func provisionedUsername(name string) string {
+	name = strings.TrimSpace(name)
+	if len(name) <= 29 && ValidateUsername(name) == nil {
+		return name
+	}
+
+	var b strings.Builder
+	for _, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+			b.WriteRune(c)
+		case (c == '.' || c == '-' || c == '_') && b.Len() > 0:
+			b.WriteRune(c)
+		}
+		if b.Len() == 29 {
+			break
+		}
+	}
+	sanitized := b.String()
+	if ValidateUsername(sanitized) != nil {
+		return "user"
+	}
+	return sanitized
+}
+
+// identities linked to a user, oldest first
+func ListIdentities(db *sql.DB, userID int) ([]models.Identity, error) {
+	rows, err := db.Query(`
+		SELECT id, user_id, issuer, subject, email, created_at, last_login_at
+		FROM user_identities
+		WHERE user_id = ?
+		ORDER BY id
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	identities := []models.Identity{}
+	for rows.Next() {
+		var identity models.Identity
+		var lastLogin sql.NullTime
+		err := rows.Scan(
+			&identity.ID,
+			&identity.UserID,
+			&identity.Issuer,
+			&identity.Subject,
+			&identity.Email,
+			&identity.CreatedAt,
+			&lastLogin,
+		)
+		if err != nil {
+			continue
+		}
+		if lastLogin.Valid {
+			identity.LastLoginAt = &lastLogin.Time
+		}
+		identities = append(identities, identity)
+	}
+	return identities, nil
+}
+
+// detach an identity, refused when it is the account's last way in
+func UnlinkIdentity(db *sql.DB, userID, identityID int, passwordLogin bool) error {
+	var hash string
+	var count int
+	err := db.QueryRow(`
+		SELECT u.password_hash, (SELECT COUNT(*) FROM user_identities WHERE user_id = u.id)
+		FROM users u WHERE u.id = ?
+	`, userID).Scan(&hash, &count)
+	if err != nil {
+		return err
+	}
+	if count <= 1 && (hash == "" || !passwordLogin) {
+		return ErrLastLogin
+	}
+
+	_, err = db.Exec("DELETE FROM user_identities WHERE id = ? AND user_id = ?", identityID, userID)
+	return err
+}
@@ -0,0 +1,171 @@
+package auth
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"strings"
+	"taskbox/internal/models"
+	"time"
+)
+
+// registration modes
+const (
+	RegistrationOpen   = "open"
+	RegistrationInvite = "invite"
+	RegistrationClosed = "closed"
+)
+
+var (
+	ErrInvalidInvite = errors.New("invite code is invalid, used up or expired")
+	ErrUsernameTaken = errors.New("username already exists")
+)
+
+// 3 to 32 letters, digits, dots, dashes or underscores, starting with a letter or digit
+func ValidateUsername(username string) error {
+	if len(username) < 3 || len(username) > 32 {
+		return errors.New("username must be 3 to 32 characters")
+	}
+	for i, c := range username {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case (c == '.' || c == '-' || c == '_') && i > 0:
+		default:
+			return errors.New("username may only use letters, digits, dots, dashes and underscores, and must start with a letter or digit")
+		}
+	}
+	return nil
+}
+
+// new invite code good for maxUses registrations until it expires
+func CreateInvite(db *sql.DB, createdBy, maxUses int, ttl time.Duration) (string, error) {
+	b := make([]byte, 10)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	code := strings.ToLower(base32.StdEncoding.EncodeToString(b))
+
+	_, err := db.Exec(
+		"INSERT INTO invites (code, created_by, max_uses, expires_at) VALUES (?, ?, ?, ?)",
+		code, createdBy, maxUses, time.Now().Add(ttl).UTC(),
+	)
+	if err != nil {
+		return "", err
+	}
+	return code, nil
+}
+
+// invites made by a user, or by everyone when all is set, newest first
+func ListInvites(db *sql.DB, userID int, all bool) ([]models.Invite, error) {
+	rows, err := db.Query(`
+		SELECT i.id, i.code, i.created_by, u.username, i.max_uses, i.uses,
+			i.expires_at, i.revoked_at, i.created_at
+		FROM invites i
+		JOIN users u ON u.id = i.created_by
+		WHERE i.created_by = ? OR ?
+		ORDER BY i.id DESC
+	`, userID, all)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	now := time.Now()
+	invites := []models.Invite{}
+	for rows.Next() {
+		var invite models.Invite
+		var revokedAt sql.NullTime
+		err := rows.Scan(
+			&invite.ID,
+			&invite.Code,
+			&invite.CreatedBy,
+			&invite.CreatedByName,
+			&invite.MaxUses,
+			&invite.Uses,
+			&invite.ExpiresAt,
+			&revokedAt,
+			&invite.CreatedAt,
+		)
+		if err != nil {
+			continue
+		}
+		if revokedAt.Valid {
+			invite.RevokedAt = &revokedAt.Time
+		}
+		invite.Active = !revokedAt.Valid && invite.Uses < invite.MaxUses && invite.ExpiresAt.After(now)
+		invites = append(invites, invite)
+	}
+	return invites, nil
+}
+
+// revoke an invite the user made, admins may revoke any
+func RevokeInvite(db *sql.DB, inviteID, userID int, admin bool) error {
+	result, err := db.Exec(`
+		UPDATE invites SET revoked_at = CURRENT_TIMESTAMP
+		WHERE id = ? AND (created_by = ? OR ?) AND revoked_at IS NULL
+	`, inviteID, userID, admin)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// take one use of a valid invite inside a registration transaction
+func useInvite(tx *sql.Tx, code string) (int, error) {
+	var inviteID int
+	err := tx.QueryRow(
+		"SELECT id FROM invites WHERE code = ? AND revoked_at IS NULL AND uses < max_uses AND expires_at > ?",
+		strings.ToLower(strings.TrimSpace(code)), time.Now().UTC(),
+	).Scan(&inviteID)
+	if err != nil {
+		return 0, ErrInvalidInvite
+	}
+	if _, err := tx.Exec("UPDATE invites SET uses = uses + 1 WHERE id = ?", inviteID); err != nil {
+		return 0, err
+	}
+	return inviteID, nil
+}
+
+// create an account with an invite, using one of its uses
+func RegisterWithInvite(db *sql.DB, username, password, code string) (*models.User, error) {
+	hash, err := HashPassword(password)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var taken bool
+	tx.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE username = ?)", username).Scan(&taken)
+	if taken {
+		return nil, ErrUsernameTaken
+	}
+
+	inviteID, err := useInvite(tx, code)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := tx.Exec(
+		"INSERT INTO users (username, password_hash, invite_id) VALUES (?, ?, ?)",
+		username, hash, inviteID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("create user: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	id, _ := result.LastInsertId()
+	return &models.User{ID: int(id), Username: username, PasswordHash: hash}, nil
+}
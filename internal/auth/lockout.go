@@ -0,0 +1,78 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// lockout policy, overridable at startup
+var (
+	MaxFailedLogins = 10
+	LockoutDuration = 15 * time.Minute
+)
+
+var ErrLocked = errors.New("account temporarily locked")
+
+// reasons stored with each failed attempt
+const (
+	ReasonBadPassword = "bad_password"
+	ReasonBadCode     = "bad_code"
+	ReasonUnknownUser = "unknown_user"
+)
+
+// time until the account unlocks, zero when it is not locked
+func LockedFor(db *sql.DB, username string) time.Duration {
+	var until sql.NullTime
+	err := db.QueryRow("SELECT locked_until FROM users WHERE username = ?", username).Scan(&until)
+	if err != nil || !until.Valid {
+		return 0
+	}
+	if wait := time.Until(until.Time); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// audit a failed attempt and lock the account at the limit, starting the count over
+func RecordFailedLogin(db *sql.DB, username, ip, userAgent, reason string) error {
+	var userID sql.NullInt64
+	db.QueryRow("SELECT id FROM users WHERE username = ?", username).Scan(&userID)
+	if !userID.Valid && reason == ReasonBadPassword {
+		reason = ReasonUnknownUser
+	}
+
+	_, err := db.Exec(
+		"INSERT INTO login_attempts (username, user_id, ip, user_agent, reason) VALUES (?, ?, ?, ?, ?)",
+		username, userID, ip, userAgent, reason,
+	)
+	if err != nil || (reason != ReasonBadPassword && reason != ReasonBadCode) {
+		return err
+	}
+
+	_, err = db.Exec(`
+		UPDATE users
+		SET failed_logins = CASE WHEN failed_logins + 1 >= ? THEN 0 ELSE failed_logins + 1 END,
+			locked_until = CASE WHEN failed_logins + 1 >= ? THEN ? ELSE locked_until END
+		WHERE id = ?
+	`, MaxFailedLogins, MaxFailedLogins, time.Now().Add(LockoutDuration).UTC(), userID.Int64)
+	return err
+}
+
+// clear the failure count after a successful login
+func ResetFailedLogins(db *sql.DB, userID int) error {
+	_, err := db.Exec("UPDATE users SET failed_logins = 0, locked_until = NULL WHERE id = ?", userID)
+	return err
+}
+
+// lift a lockout by hand, used by the unlock command
+func UnlockUser(db *sql.DB, username string) error {
+	result, err := db.Exec("UPDATE users SET failed_logins = 0, locked_until = NULL WHERE username = ?", username)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
@@ -0,0 +1,221 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"taskbox/internal/models"
+	"time"
+)
+
+// how long a reset link stays valid
+var ResetTokenTTL = time.Hour
+
+var (
+	ErrInvalidResetToken = errors.New("invalid or expired reset token")
+	ErrWrongPassword     = errors.New("current password is incorrect")
+)
+
+// tokens are base64("{user id}:{expiry unix}:{nonce}") plus its hmac-sha256, the stored nonce hash makes them single use
+func CreateResetToken(db *sql.DB, userID int) (string, error) {
+	key, err := signingKey(db)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	expires := time.Now().Add(ResetTokenTTL)
+
+	_, err = db.Exec(
+		"INSERT INTO password_resets (user_id, nonce_hash, expires_at) VALUES (?, ?, ?)",
+		userID, hashNonce(nonce), expires.UTC(),
+	)
+	if err != nil {
+		return "", err
+	}
+
+	payload := fmt.Sprintf("%d:%d:%s", userID, expires.Unix(), hex.EncodeToString(nonce))
+	encoded := base64.RawURLEncoding.EncodeToString([]byte(payload))
+	return encoded + "." + sign(key, encoded), nil
+}
+
+// check a reset token without using it up
+func CheckResetToken(db *sql.DB, token string) (int, error) {
+	userID, nonce, err := parseResetToken(db, token)
+	if err != nil {
+		return 0, err
+	}
+
+	var id int
+	err = db.QueryRow(`
+		SELECT id FROM password_resets
+		WHERE user_id = ? AND nonce_hash = ? AND used_at IS NULL AND expires_at > ?
+	`, userID, hashNonce(nonce), time.Now().UTC()).Scan(&id)
+	if err != nil {
+		return 0, ErrInvalidResetToken
+	}
+	return userID, nil
+}
+
+// set a new password with a reset token, revoking every token and session and lifting any lockout
+func ResetPassword(db *sql.DB, token, password string) (int, error) {
+	userID, nonce, err := parseResetToken(db, token)
+	if err != nil {
+		return 0, err
+	}
+
+	hash, err := HashPassword(password)
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		UPDATE password_resets SET used_at = CURRENT_TIMESTAMP
+		WHERE user_id = ? AND nonce_hash = ? AND used_at IS NULL AND expires_at > ?
+	`, userID, hashNonce(nonce), time.Now().UTC())
+	if err != nil {
+		return 0, err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return 0, ErrInvalidResetToken
+	}
+
+	_, err = tx.Exec("UPDATE users SET password_hash = ?, failed_logins = 0, locked_until = NULL WHERE id = ?", hash, userID)
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec("UPDATE password_resets SET used_at = CURRENT_TIMESTAMP WHERE user_id = ? AND used_at IS NULL", userID)
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec("DELETE FROM sessions WHERE user_id = ?", userID)
+	if err != nil {
+		return 0, err
+	}
+
+	return userID, tx.Commit()
+}
+
+// change a signed-in user's password after checking the current one, revoking every other session
+func ChangePassword(db *sql.DB, user *models.User, current, password, keepToken string) error {
+	if !CheckPassword(current, user.PasswordHash) {
+		return ErrWrongPassword
+	}
+
+	hash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	if _, err := db.Exec("UPDATE users SET password_hash = ? WHERE id = ?", hash, user.ID); err != nil {
+		return err
+	}
+	return RevokeOtherSessions(db, user.ID, keepToken)
+}
+
+// find the account a reset was requested for, by username or email
+func FindUserForReset(db *sql.DB, login string) (*models.User, error) {
+	var user models.User
+	err := db.QueryRow(`
+		SELECT id, username, email FROM users
+		WHERE (username = ? OR email = ?) AND email IS NOT NULL AND email != ''
+	`, login, strings.ToLower(login)).Scan(&user.ID, &user.Username, &user.Email)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// set or clear the user's email address
+func SetEmail(db *sql.DB, userID int, email string) error {
+	var value interface{}
+	if email != "" {
+		value = strings.ToLower(email)
+	}
+	_, err := db.Exec("UPDATE users SET email = ? WHERE id = ?", value, userID)
+	return err
+}
+
+func parseResetToken(db *sql.DB, token string) (int, []byte, error) {
+	encoded, signature, ok := strings.Cut(token, ".")
+	if !ok {
+		return 0, nil, ErrInvalidResetToken
+	}
+
+	key, err := signingKey(db)
+	if err != nil {
+		return 0, nil, err
+	}
+	if !hmac.Equal([]byte(signature), []byte(sign(key, encoded))) {
+		return 0, nil, ErrInvalidResetToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return 0, nil, ErrInvalidResetToken
+	}
+	fields := strings.Split(string(payload), ":")
+	if len(fields) != 3 {
+		return 0, nil, ErrInvalidResetToken
+	}
+
+	userID, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return 0, nil, ErrInvalidResetToken
+	}
+	expires, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return 0, nil, ErrInvalidResetToken
+	}
+	nonce, err := hex.DecodeString(fields[2])
+	if err != nil {
+		return 0, nil, ErrInvalidResetToken
+	}
+
+	return userID, nonce, nil
+}
+
+func sign(key []byte, data string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func hashNonce(nonce []byte) string {
+	sum := sha256.Sum256(nonce)
+	return hex.EncodeToString(sum[:])
+}
+
+// per-install signing key, created on first use
+func signingKey(db *sql.DB) ([]byte, error) {
+	var value string
+	err := db.QueryRow("SELECT value FROM app_settings WHERE key = 'signing_key'").Scan(&value)
+	if err == sql.ErrNoRows {
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		db.Exec("INSERT OR IGNORE INTO app_settings (key, value) VALUES ('signing_key', ?)", hex.EncodeToString(b))
+		err = db.QueryRow("SELECT value FROM app_settings WHERE key = 'signing_key'").Scan(&value)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return hex.DecodeString(value)
+}
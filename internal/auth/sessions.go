@@ -0,0 +1,103 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"net"
+	"net/http"
+	"taskbox/internal/metrics"
+	"taskbox/internal/models"
+	"time"
+)
+
+// session lifetimes, overridable at startup
+var (
+	IdleTimeout     = 7 * 24 * time.Hour
+	AbsoluteTimeout = 30 * 24 * time.Hour
+)
+
+// record activity at most once a minute per session
+func TouchSession(db *sql.DB, token, ip, userAgent string) {
+	db.Exec(`
+		UPDATE sessions
+		SET last_seen_at = CURRENT_TIMESTAMP, ip = ?, user_agent = ?
+		WHERE token = ? AND last_seen_at < datetime('now', '-60 seconds')
+	`, ip, userAgent, token)
+}
+
+// list a user's active sessions, most recently used first
+func ListSessions(db *sql.DB, userID int) ([]models.Session, error) {
+	rows, err := db.Query(`
+		SELECT id, user_id, token, ip, user_agent, last_seen_at, expires_at, created_at
+		FROM sessions
+		WHERE user_id = ?
+			AND expires_at > CURRENT_TIMESTAMP
+			AND last_seen_at > datetime('now', '-' || ? || ' seconds')
+			AND pending_2fa = 0
+		ORDER BY last_seen_at DESC
+	`, userID, int(IdleTimeout.Seconds()))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []models.Session{}
+	for rows.Next() {
+		var s models.Session
+		err := rows.Scan(&s.ID, &s.UserID, &s.Token, &s.IP, &s.UserAgent, &s.LastSeenAt, &s.ExpiresAt, &s.CreatedAt)
+		if err != nil {
+			continue
+		}
+		sessions = append(sessions, s)
+	}
+
+	return sessions, nil
+}
+
+// revoke one of a user's sessions
+func RevokeSession(db *sql.DB, userID, sessionID int) error {
+	_, err := db.Exec("DELETE FROM sessions WHERE id = ? AND user_id = ?", sessionID, userID)
+	return err
+}
+
+// revoke every session of a user except the given token
+func RevokeOtherSessions(db *sql.DB, userID int, keepToken string) error {
+	_, err := db.Exec("DELETE FROM sessions WHERE user_id = ? AND token != ?", userID, keepToken)
+	return err
+}
+
+// delete expired and idle sessions until ctx is cancelled
+func SweepSessions(ctx context.Context, db *sql.DB, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		result, err := db.Exec(`
+			DELETE FROM sessions
+			WHERE expires_at <= CURRENT_TIMESTAMP
+				OR last_seen_at <= datetime('now', '-' || ? || ' seconds')
+		`, int(IdleTimeout.Seconds()))
+		metrics.JobDone("session_sweep", err)
+		if err != nil {
+			slog.Error("session sweep failed", "err", err)
+		} else if n, _ := result.RowsAffected(); n > 0 {
+			slog.Info("swept expired sessions", "count", n)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// client address without the port
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,221 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"taskbox/internal/models"
+	"taskbox/internal/totp"
+	"time"
+)
+
+// how long a password-verified login may wait for its second factor
+var PendingTimeout = 10 * time.Minute
+
+const recoveryCodeCount = 10
+
+var (
+	ErrInvalidCode     = errors.New("invalid authentication code")
+	ErrTwoFactorActive = errors.New("two-factor authentication already enabled")
+)
+
+// whether the user must pass a second factor at login
+func TwoFactorEnabled(db *sql.DB, userID int) bool {
+	var enabled bool
+	db.QueryRow("SELECT totp_enabled_at IS NOT NULL FROM users WHERE id = ?", userID).Scan(&enabled)
+	return enabled
+}
+
+// store a fresh secret for enrollment, it only takes effect once confirmed
+func BeginTOTPEnrollment(db *sql.DB, userID int) (string, error) {
+	if TwoFactorEnabled(db, userID) {
+		return "", ErrTwoFactorActive
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return "", err
+	}
+	_, err = db.Exec("UPDATE users SET totp_secret = ?, totp_last_step = 0 WHERE id = ?", secret, userID)
+	return secret, err
+}
+
+// the secret awaiting confirmation, if any
+func PendingTOTPSecret(db *sql.DB, userID int) string {
+	var secret sql.NullString
+	db.QueryRow("SELECT totp_secret FROM users WHERE id = ? AND totp_enabled_at IS NULL", userID).Scan(&secret)
+	return secret.String
+}
+
+// confirm enrollment with a first code and hand out recovery codes
+func EnableTOTP(db *sql.DB, userID int, code string) ([]string, error) {
+	secret := PendingTOTPSecret(db, userID)
+	if secret == "" {
+		return nil, ErrInvalidCode
+	}
+	step, ok := totp.Validate(secret, code, time.Now())
+	if !ok {
+		return nil, ErrInvalidCode
+	}
+
+	_, err := db.Exec(
+		"UPDATE users SET totp_enabled_at = CURRENT_TIMESTAMP, totp_last_step = ? WHERE id = ?",
+		step, userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return RegenerateRecoveryCodes(db, userID)
+}
+
+// turn the second factor off and drop its recovery codes
+func DisableTOTP(db *sql.DB, userID int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("UPDATE users SET totp_secret = NULL, totp_enabled_at = NULL, totp_last_step = 0 WHERE id = ?", userID)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM recovery_codes WHERE user_id = ?", userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// clear a user's second factor by username, used by the reset-2fa command
+func ResetTwoFactor(db *sql.DB, username string) error {
+	var userID int
+	if err := db.QueryRow("SELECT id FROM users WHERE username = ?", username).Scan(&userID); err != nil {
+		return err
+	}
+	return DisableTOTP(db, userID)
+}
+
+// check a totp code, accepted once per step, or failing that a recovery code which is then used up
+func VerifySecondFactor(db *sql.DB, userID int, code string) error {
+	var secret sql.NullString
+	var lastStep int64
+	err := db.QueryRow(
+		"SELECT totp_secret, totp_last_step FROM users WHERE id = ? AND totp_enabled_at IS NOT NULL",
+		userID,
+	).Scan(&secret, &lastStep)
+	if err != nil {
+		return ErrInvalidCode
+	}
+
+	if step, ok := totp.Validate(secret.String, code, time.Now()); ok {
+		result, err := db.Exec(
+			"UPDATE users SET totp_last_step = ? WHERE id = ? AND totp_last_step < ?",
+			step, userID, step,
+		)
+		if err != nil {
+			return err
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			return ErrInvalidCode
+		}
+		return nil
+	}
+
+	result, err := db.Exec(
+		"UPDATE recovery_codes SET used_at = CURRENT_TIMESTAMP WHERE user_id = ? AND code_hash = ? AND used_at IS NULL",
+		userID, hashRecoveryCode(code),
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrInvalidCode
+	}
+	return nil
+}
+
+// replace all recovery codes, the plain codes are only ever returned here
+func RegenerateRecoveryCodes(db *sql.DB, userID int) ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 10)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(base32.StdEncoding.EncodeToString(b))
+		codes[i] = code[:5] + "-" + code[5:10]
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM recovery_codes WHERE user_id = ?", userID); err != nil {
+		return nil, err
+	}
+	for _, code := range codes {
+		_, err := tx.Exec(
+			"INSERT INTO recovery_codes (user_id, code_hash) VALUES (?, ?)",
+			userID, hashRecoveryCode(code),
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return codes, tx.Commit()
+}
+
+// unused recovery codes left
+func RecoveryCodesLeft(db *sql.DB, userID int) int {
+	var n int
+	db.QueryRow("SELECT COUNT(*) FROM recovery_codes WHERE user_id = ? AND used_at IS NULL", userID).Scan(&n)
+	return n
+}
+
+// codes are compared without case, spaces or dashes
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// short session that only proves the password, swapped for a full one after the second factor
+func CreatePendingSession(db *sql.DB, userID int, ip, userAgent string) (string, error) {
+	token, err := GenerateToken()
+	if err != nil {
+		return "", err
+	}
+
+	_, err = db.Exec(`
+		INSERT INTO sessions (user_id, token, ip, user_agent, last_seen_at, expires_at, pending_2fa)
+		VALUES (?, ?, ?, ?, CURRENT_TIMESTAMP, datetime('now', '+' || ? || ' seconds'), 1)
+	`, userID, token, ip, userAgent, int(PendingTimeout.Seconds()))
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// user behind a session still waiting for its second factor
+func GetPendingUser(db *sql.DB, token string) (*models.User, error) {
+	var user models.User
+	err := db.QueryRow(`
+		SELECT u.id, u.username
+		FROM users u
+		JOIN sessions s ON s.user_id = u.id
+		WHERE s.token = ? AND s.pending_2fa = 1 AND s.expires_at > CURRENT_TIMESTAMP
+			AND u.disabled_at IS NULL
+	`, token).Scan(&user.ID, &user.Username)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
@@ -0,0 +1,68 @@
+package calendar
+
+import (
+	"fmt"
+	"strings"
+	"taskbox/internal/models"
+)
+
+// render tasks with due dates as an icalendar feed of all-day events
+func Render(tasks []models.Task, baseURL string) []byte {
+	var b strings.Builder
+	line(&b, "BEGIN:VCALENDAR")
+	line(&b, "VERSION:2.0")
+	line(&b, "PRODID:-//Gridwork//Tasks//EN")
+	line(&b, "CALSCALE:GREGORIAN")
+	line(&b, "X-WR-CALNAME:Gridwork")
+
+	for _, task := range tasks {
+		if task.DueDate == nil {
+			continue
+		}
+		due := task.DueDate.UTC()
+
+		line(&b, "BEGIN:VEVENT")
+		line(&b, "UID:"+TaskUID(task.ID))
+		line(&b, "DTSTAMP:"+task.UpdatedAt.UTC().Format("20060102T150405Z"))
+		line(&b, "DTSTART;VALUE=DATE:"+due.Format("20060102"))
+		line(&b, "DTEND;VALUE=DATE:"+due.AddDate(0, 0, 1).Format("20060102"))
+		line(&b, "SUMMARY:"+escape(task.Title))
+		if task.Description != "" {
+			line(&b, "DESCRIPTION:"+escape(task.Description))
+		}
+		line(&b, "CATEGORIES:"+escape(task.Position))
+		line(&b, fmt.Sprintf("URL:%s/?task=%d", baseURL, task.ID))
+		line(&b, "END:VEVENT")
+	}
+
+	line(&b, "END:VCALENDAR")
+	return []byte(b.String())
+}
+
+// escape text values per rfc 5545
+func escape(s string) string {
+	return strings.NewReplacer(
+		`\`, `\\`,
+		";", `\;`,
+		",", `\,`,
+		"\r\n", `\n`,
+		"\n", `\n`,
+	).Replace(s)
+}
+
+// write a content line folded at 75 octets
+func line(b *strings.Builder, s string) {
+	limit := 75
+	for len(s) > limit {
+		cut := limit
+		// don't split a utf-8 sequence
+		for cut > 0 && s[cut]&0xC0 == 0x80 {
+			cut--
+		}
+		b.WriteString(s[:cut] + "\r\n ")
+		s = s[cut:]
+		// continuation lines lose one octet to the leading space
+		limit = 74
+	}
+	b.WriteString(s + "\r\n")
+}
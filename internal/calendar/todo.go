@@ -0,0 +1,172 @@
+package calendar
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"taskbox/internal/models"
+	"time"
+)
+
+var ErrNoTodo = errors.New("calendar object has no VTODO")
+
+// fields read from a client supplied VTODO
+type Todo struct {
+	UID         string
+	Summary     string
+	Description string
+	Due         *time.Time
+	Categories  []string
+	Completed   bool
+}
+
+// default uid for tasks that were not created over caldav
+func TaskUID(taskID int) string {
+	return fmt.Sprintf("task-%d@gridwork", taskID)
+}
+
+// render a single task as a calendar object holding one VTODO
+func RenderTodo(task models.Task, uid, baseURL string) []byte {
+	var b strings.Builder
+	line(&b, "BEGIN:VCALENDAR")
+	line(&b, "VERSION:2.0")
+	line(&b, "PRODID:-//Gridwork//Tasks//EN")
+	line(&b, "BEGIN:VTODO")
+	line(&b, "UID:"+escape(uid))
+	line(&b, "DTSTAMP:"+task.UpdatedAt.UTC().Format("20060102T150405Z"))
+	line(&b, "CREATED:"+task.CreatedAt.UTC().Format("20060102T150405Z"))
+	line(&b, "LAST-MODIFIED:"+task.UpdatedAt.UTC().Format("20060102T150405Z"))
+	line(&b, "SUMMARY:"+escape(task.Title))
+	if task.Description != "" {
+		line(&b, "DESCRIPTION:"+escape(task.Description))
+	}
+	if task.DueDate != nil {
+		line(&b, "DUE;VALUE=DATE:"+task.DueDate.UTC().Format("20060102"))
+	}
+	if len(task.Tags) > 0 {
+		tags := make([]string, len(task.Tags))
+		for i, tag := range task.Tags {
+			tags[i] = escape(tag)
+		}
+		line(&b, "CATEGORIES:"+strings.Join(tags, ","))
+	}
+	if task.Position == "archive" {
+		line(&b, "STATUS:COMPLETED")
+		line(&b, "COMPLETED:"+task.UpdatedAt.UTC().Format("20060102T150405Z"))
+	} else {
+		line(&b, "STATUS:NEEDS-ACTION")
+	}
+	line(&b, fmt.Sprintf("URL:%s/?task=%d", baseURL, task.ID))
+	line(&b, "END:VTODO")
+	line(&b, "END:VCALENDAR")
+	return []byte(b.String())
+}
+
+// parse the first VTODO of a calendar object
+func ParseTodo(data []byte) (*Todo, error) {
+	// unfold continuation lines
+	text := strings.ReplaceAll(string(data), "\r\n", "\n")
+	text = strings.ReplaceAll(text, "\n ", "")
+	text = strings.ReplaceAll(text, "\n\t", "")
+
+	var todo *Todo
+	depth := 0
+	for _, raw := range strings.Split(text, "\n") {
+		name, value := splitLine(raw)
+		switch {
+		case name == "BEGIN" && strings.EqualFold(value, "VTODO") && todo == nil:
+			todo = &Todo{}
+			depth = 1
+			continue
+		case todo == nil || depth == 0:
+			continue
+		case name == "BEGIN":
+			// skip nested components such as VALARM
+			depth++
+			continue
+		case name == "END":
+			depth--
+			if depth == 0 {
+				return todo, nil
+			}
+			continue
+		case depth > 1:
+			continue
+		}
+
+		switch name {
+		case "UID":
+			todo.UID = unescape(value)
+		case "SUMMARY":
+			todo.Summary = unescape(value)
+		case "DESCRIPTION":
+			todo.Description = unescape(value)
+		case "DUE":
+			if len(value) >= 8 {
+				if t, err := time.Parse("20060102", value[:8]); err == nil {
+					todo.Due = &t
+				}
+			}
+		case "CATEGORIES":
+			for _, c := range splitEscaped(value) {
+				if c = strings.TrimSpace(unescape(c)); c != "" {
+					todo.Categories = append(todo.Categories, c)
+				}
+			}
+		case "STATUS":
+			todo.Completed = strings.EqualFold(value, "COMPLETED")
+		case "COMPLETED":
+			todo.Completed = true
+		}
+	}
+
+	return nil, ErrNoTodo
+}
+
+// split a content line into property name and value, dropping parameters
+func splitLine(s string) (string, string) {
+	inQuote := false
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			inQuote = !inQuote
+		case ':':
+			if inQuote {
+				continue
+			}
+			head := s[:i]
+			if j := strings.IndexByte(head, ';'); j >= 0 {
+				head = head[:j]
+			}
+			return strings.ToUpper(strings.TrimSpace(head)), s[i+1:]
+		}
+	}
+	return "", ""
+}
+
+// split a list value on commas that are not escaped
+func splitEscaped(s string) []string {
+	parts := []string{}
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case ',':
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// reverse of escape
+func unescape(s string) string {
+	return strings.NewReplacer(
+		`\\`, `\`,
+		`\;`, ";",
+		`\,`, ",",
+		`\n`, "\n",
+		`\N`, "\n",
+	).Replace(s)
+}
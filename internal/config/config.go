@@ -0,0 +1,400 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// every server setting, from the toml key, the env name or a flag (toml key with dashes), later sources win
+type Config struct {
+	// server
+	Addr    string `toml:"addr" env:"LISTEN_ADDR" help:"http listen address"`
+	BaseURL string `toml:"base_url" env:"BASE_URL" help:"public url used in emailed links and the sso callback"`
+	DevMode bool   `toml:"dev_mode" env:"DEV_MODE" help:"browser auto-reload and logged outgoing mail"`
+
+	// logging
+	LogFormat string `toml:"log_format" env:"LOG_FORMAT" help:"text or json"`
+	LogLevel  string `toml:"log_level" env:"LOG_LEVEL" help:"debug, info, warn or error"`
+
+	// http server limits and shutdown
+	ReadTimeout       time.Duration `toml:"read_timeout" env:"READ_TIMEOUT" help:"longest time to read a whole request"`
+	ReadHeaderTimeout time.Duration `toml:"read_header_timeout" env:"READ_HEADER_TIMEOUT" help:"longest time to read request headers"`
+	WriteTimeout      time.Duration `toml:"write_timeout" env:"WRITE_TIMEOUT" help:"longest time to write a response, per event for live streams"`
+	IdleTimeout       time.Duration `toml:"idle_timeout" env:"IDLE_TIMEOUT" help:"how long keep-alive connections stay open"`
+	MaxHeaderBytes    int           `toml:"max_header_bytes" env:"MAX_HEADER_BYTES" help:"largest accepted request header"`
+	ShutdownTimeout   time.Duration `toml:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT" help:"how long to drain requests on SIGTERM"`
+
+	// prometheus metrics on metrics_addr, or on the main listener behind metrics_token; off when neither is set
+	MetricsAddr  string `toml:"metrics_addr" env:"METRICS_ADDR" help:"separate listen address for /metrics"`
+	MetricsToken string `toml:"metrics_token" env:"METRICS_TOKEN" secret:"true" help:"bearer token required to scrape /metrics"`
+
+	// storage and assets, embedded in the binary unless assets_from_disk reads the directories below
+	DatabasePath   string `toml:"database_path" env:"DATABASE_PATH" help:"sqlite database file"`
+	AssetsFromDisk bool   `toml:"assets_from_disk" env:"ASSETS_FROM_DISK" help:"read templates, migrations and static files from their directories instead of the binary"`
+	MigrationsDir  string `toml:"migrations_dir" env:"MIGRATIONS_DIR" help:"directory of NNN_*.sql migrations"`
+	TemplatesDir   string `toml:"templates_dir" env:"TEMPLATES_DIR" help:"directory of html templates"`
+	StaticDir      string `toml:"static_dir" env:"STATIC_DIR" help:"directory served under /static/"`
+	SCSSDir        string `toml:"scss_dir" env:"SCSS_DIR" help:"scss sources compiled into static_dir/css"`
+	SassBinary     string `toml:"sass_binary" env:"SASS_BINARY" help:"dart sass executable, looked up on PATH and in the usual install locations when empty"`
+	PrebuiltCSSDir string `toml:"prebuilt_css_dir" env:"PREBUILT_CSS_DIR" help:"css copied into static_dir/css when sass is not available"`
+
+	// sessions and login
+	SessionIdleHours    int    `toml:"session_idle_hours" env:"SESSION_IDLE_HOURS" help:"sign out after this many idle hours"`
+	SessionMaxHours     int    `toml:"session_max_hours" env:"SESSION_MAX_HOURS" help:"sign out this many hours after login"`
+	LoginMaxFailures    int    `toml:"login_max_failures" env:"LOGIN_MAX_FAILURES" help:"failed logins before an account is locked"`
+	LoginLockoutMinutes int    `toml:"login_lockout_minutes" env:"LOGIN_LOCKOUT_MINUTES" help:"how long a locked account stays locked"`
+	RegistrationMode    string `toml:"registration_mode" env:"REGISTRATION_MODE" help:"open, invite or closed"`
+
+	// password hashing and policy
+	PasswordMinLength int `toml:"password_min_length" env:"PASSWORD_MIN_LENGTH" help:"shortest accepted password"`
+	Argon2MemoryKB    int `toml:"argon2_memory_kb" env:"ARGON2_MEMORY_KB" help:"argon2id memory cost in KiB"`
+	Argon2Time        int `toml:"argon2_time" env:"ARGON2_TIME" help:"argon2id passes"`
+	Argon2Threads     int `toml:"argon2_threads" env:"ARGON2_THREADS" help:"argon2id parallelism"`
+
+	// outgoing mail for password resets
+	MailSMTPAddr string `toml:"mail_smtp_addr" env:"MAIL_SMTP_ADDR" help:"smtp relay host:port"`
+	MailFrom     string `toml:"mail_from" env:"MAIL_FROM" help:"sender address"`
+	MailUsername string `toml:"mail_username" env:"MAIL_USERNAME" help:"smtp relay username"`
+	MailPassword string `toml:"mail_password" env:"MAIL_PASSWORD" secret:"true" help:"smtp relay password"`
+
+	// email capture to the inbox
+	SMTPAddr     string `toml:"smtp_addr" env:"SMTP_ADDR" help:"listen address for incoming mail, off when empty"`
+	SMTPDomain   string `toml:"smtp_domain" env:"SMTP_DOMAIN" help:"domain of inbox addresses"`
+	SMTPMaxBytes int64  `toml:"smtp_max_bytes" env:"SMTP_MAX_BYTES" help:"largest accepted message"`
+
+	// openid connect single sign-on
+	OIDCIssuer               string `toml:"oidc_issuer" env:"OIDC_ISSUER" help:"issuer url, sso is off when empty"`
+	OIDCClientID             string `toml:"oidc_client_id" env:"OIDC_CLIENT_ID" help:"client id"`
+	OIDCClientSecret         string `toml:"oidc_client_secret" env:"OIDC_CLIENT_SECRET" secret:"true" help:"client secret"`
+	OIDCRedirectURL          string `toml:"oidc_redirect_url" env:"OIDC_REDIRECT_URL" help:"callback url, defaults to base_url/auth/oidc/callback"`
+	OIDCName                 string `toml:"oidc_name" env:"OIDC_NAME" help:"provider name on the login button"`
+	OIDCDisablePasswordLogin bool   `toml:"oidc_disable_password_login" env:"OIDC_DISABLE_PASSWORD_LOGIN" help:"make sso the only way in"`
+}
+
+// settings used when nothing else is given, relative to the working directory
+func Default() Config {
+	return Config{
+		Addr:      ":1234",
+		LogFormat: "text",
+		LogLevel:  "info",
+
+		ReadTimeout:       30 * time.Second,
+		ReadHeaderTimeout: 5 * time.Second,
+		WriteTimeout:      60 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+		MaxHeaderBytes:    64 << 10,
+		ShutdownTimeout:   20 * time.Second,
+
+		DatabasePath:   "./taskbox.db",
+		MigrationsDir:  "./migrations",
+		TemplatesDir:   "./templates",
+		StaticDir:      "./static",
+		SCSSDir:        "./scss",
+		PrebuiltCSSDir: "./css",
+
+		SessionIdleHours:    24 * 7,
+		SessionMaxHours:     24 * 30,
+		LoginMaxFailures:    10,
+		LoginLockoutMinutes: 15,
+		RegistrationMode:    "open",
+
+		PasswordMinLength: 10,
+		Argon2MemoryKB:    64 * 1024,
+		Argon2Time:        3,
+		Argon2Threads:     2,
+
+		SMTPDomain:   "localhost",
+		SMTPMaxBytes: 10 << 20,
+	}
+}
+
+// effective config from defaults, the -config or TASKBOX_CONFIG file, the environment and flags; returns leftover args
+func Load(args []string) (*Config, []string, error) {
+	cfg := Default()
+
+	flags := flag.NewFlagSet("taskbox", flag.ContinueOnError)
+	path := flags.String("config", os.Getenv("TASKBOX_CONFIG"), "toml config file")
+	set := map[string]string{}
+	for _, f := range cfg.fields() {
+		flags.Var(&flagValue{name: f.flag, set: set, def: fmt.Sprint(f.value.Interface()), bool: f.value.Kind() == reflect.Bool}, f.flag, f.help)
+	}
+	if err := flags.Parse(args); err != nil {
+		return nil, nil, err
+	}
+
+	if *path != "" {
+		md, err := toml.DecodeFile(*path, &cfg)
+		if err != nil {
+			return nil, nil, fmt.Errorf("config file %s: %w", *path, err)
+		}
+		if undecoded := md.Undecoded(); len(undecoded) > 0 {
+			return nil, nil, fmt.Errorf("config file %s: unknown setting %q", *path, undecoded[0].String())
+		}
+	}
+
+	for _, f := range cfg.fields() {
+		if v, ok := os.LookupEnv(f.env); ok && v != "" {
+			if err := f.set(v); err != nil {
+				return nil, nil, fmt.Errorf("%s: %w", f.env, err)
+			}
+		}
+	}
+	for _, f := range cfg.fields() {
+		if v, ok := set[f.flag]; ok {
+			if err := f.set(v); err != nil {
+				return nil, nil, fmt.Errorf("-%s: %w", f.flag, err)
+			}
+		}
+	}
+
+	return &cfg, flags.Args(), cfg.Validate()
+}
+
+// check every setting and report all problems at once
+func (c *Config) Validate() error {
+	var errs []error
+	fail := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if _, _, err := net.SplitHostPort(c.Addr); err != nil {
+		fail("addr %q: %v", c.Addr, err)
+	}
+	for _, d := range []struct {
+		key   string
+		value time.Duration
+	}{
+		{"read_timeout", c.ReadTimeout},
+		{"read_header_timeout", c.ReadHeaderTimeout},
+		{"write_timeout", c.WriteTimeout},
+		{"idle_timeout", c.IdleTimeout},
+		{"shutdown_timeout", c.ShutdownTimeout},
+	} {
+		if d.value <= 0 {
+			fail("%s must be positive, got %s", d.key, d.value)
+		}
+	}
+	if c.MaxHeaderBytes < 4<<10 {
+		fail("max_header_bytes must be at least 4096, got %d", c.MaxHeaderBytes)
+	}
+	if c.BaseURL != "" {
+		if u, err := url.Parse(c.BaseURL); err != nil || u.Scheme == "" || u.Host == "" {
+			fail("base_url %q must be an absolute url", c.BaseURL)
+		}
+	}
+
+	if c.DatabasePath == "" {
+		fail("database_path is required")
+	} else if !isDir(filepath.Dir(c.DatabasePath)) {
+		fail("database_path %q: directory %s does not exist", c.DatabasePath, filepath.Dir(c.DatabasePath))
+	}
+	if c.AssetsFromDisk {
+		for _, dir := range []struct{ key, path string }{
+			{"migrations_dir", c.MigrationsDir},
+			{"templates_dir", c.TemplatesDir},
+			{"scss_dir", c.SCSSDir},
+		} {
+			if !isDir(dir.path) {
+				fail("%s %q is not a directory", dir.key, dir.path)
+			}
+		}
+		if c.StaticDir == "" {
+			fail("static_dir is required")
+		}
+	} else if c.DevMode && !isDir(c.TemplatesDir) {
+		fail("templates_dir %q is not a directory, dev_mode reloads templates from it", c.TemplatesDir)
+	}
+
+	for _, n := range []struct {
+		key   string
+		value int
+	}{
+		{"session_idle_hours", c.SessionIdleHours},
+		{"session_max_hours", c.SessionMaxHours},
+		{"login_max_failures", c.LoginMaxFailures},
+		{"login_lockout_minutes", c.LoginLockoutMinutes},
+		{"password_min_length", c.PasswordMinLength},
+		{"argon2_memory_kb", c.Argon2MemoryKB},
+		{"argon2_time", c.Argon2Time},
+		{"argon2_threads", c.Argon2Threads},
+	} {
+		if n.value <= 0 {
+			fail("%s must be positive, got %d", n.key, n.value)
+		}
+	}
+	if c.Argon2Threads > 255 {
+		fail("argon2_threads must be at most 255, got %d", c.Argon2Threads)
+	}
+	if c.SMTPMaxBytes <= 0 {
+		fail("smtp_max_bytes must be positive, got %d", c.SMTPMaxBytes)
+	}
+
+	switch c.LogFormat {
+	case "text", "json":
+	default:
+		fail("log_format %q: use text or json", c.LogFormat)
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.LogLevel)); err != nil {
+		fail("log_level %q: use debug, info, warn or error", c.LogLevel)
+	}
+
+	switch c.RegistrationMode {
+	case "open", "invite", "closed":
+	default:
+		fail("registration_mode %q: use open, invite or closed", c.RegistrationMode)
+	}
+
+	if c.MetricsAddr != "" {
+		if _, _, err := net.SplitHostPort(c.MetricsAddr); err != nil {
+			fail("metrics_addr %q: %v", c.MetricsAddr, err)
+		} else if c.MetricsAddr == c.Addr {
+			fail("metrics_addr must differ from addr")
+		}
+	}
+
+	if c.SMTPAddr != "" {
+		if _, _, err := net.SplitHostPort(c.SMTPAddr); err != nil {
+			fail("smtp_addr %q: %v", c.SMTPAddr, err)
+		}
+	}
+	if c.MailSMTPAddr != "" {
+		if _, _, err := net.SplitHostPort(c.MailSMTPAddr); err != nil {
+			fail("mail_smtp_addr %q: %v", c.MailSMTPAddr, err)
+		}
+		if c.MailFrom == "" {
+			fail("mail_from is required with mail_smtp_addr")
+		}
+		if c.BaseURL == "" {
+			fail("base_url is required with mail_smtp_addr")
+		}
+	}
+
+	if c.OIDCIssuer != "" && c.OIDCClientID == "" {
+		fail("oidc_client_id is required with oidc_issuer")
+	}
+	if c.OIDCIssuer == "" && c.OIDCDisablePasswordLogin {
+		fail("oidc_disable_password_login needs oidc_issuer, nobody could sign in")
+	}
+
+	return errors.Join(errs...)
+}
+
+// sso callback, derived from base_url unless set
+func (c *Config) RedirectURL() string {
+	if c.OIDCRedirectURL != "" {
+		return c.OIDCRedirectURL
+	}
+	if c.BaseURL != "" {
+		return strings.TrimSuffix(c.BaseURL, "/") + "/auth/oidc/callback"
+	}
+	return "http://localhost" + c.Addr + "/auth/oidc/callback"
+}
+
+// effective settings for the startup log, secrets masked
+func (c *Config) LogValue() slog.Value {
+	fields := c.fields()
+	attrs := make([]slog.Attr, 0, len(fields))
+	for _, f := range fields {
+		v := f.value.Interface()
+		if d, ok := v.(time.Duration); ok {
+			v = d.String()
+		}
+		if f.secret && !f.value.IsZero() {
+			v = "********"
+		}
+		attrs = append(attrs, slog.Any(f.key, v))
+	}
+	return slog.GroupValue(attrs...)
+}
+
+// one settable config field and the names it goes by
+type field struct {
+	key    string
+	env    string
+	flag   string
+	help   string
+	secret bool
+	value  reflect.Value
+}
+
+func (c *Config) fields() []field {
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+	fields := make([]field, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		tag := t.Field(i).Tag
+		fields = append(fields, field{
+			key:    tag.Get("toml"),
+			env:    tag.Get("env"),
+			flag:   strings.ReplaceAll(tag.Get("toml"), "_", "-"),
+			help:   tag.Get("help"),
+			secret: tag.Get("secret") == "true",
+			value:  v.Field(i),
+		})
+	}
+	return fields
+}
+
+func (f field) set(s string) error {
+	if f.value.Type() == reflect.TypeOf(time.Duration(0)) {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q, use e.g. 30s or 2m", s)
+		}
+		f.value.SetInt(int64(d))
+		return nil
+	}
+
+	switch f.value.Kind() {
+	case reflect.String:
+		f.value.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", s)
+		}
+		f.value.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid number %q", s)
+		}
+		f.value.SetInt(n)
+	}
+	return nil
+}
+
+// flags are collected while parsing and applied after the file and environment
+type flagValue struct {
+	name string
+	set  map[string]string
+	def  string
+	bool bool
+}
+
+func (f *flagValue) String() string { return f.def }
+
+func (f *flagValue) Set(s string) error {
+	f.set[f.name] = s
+	return nil
+}
+
+func (f *flagValue) IsBoolFlag() bool { return f.bool }
+
+func isDir(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
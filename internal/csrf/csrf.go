@@ -0,0 +1,76 @@
+package csrf
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+	"taskbox/internal/auth"
+)
+
+const (
+	cookieName = "taskbox_csrf"
+	headerName = "X-CSRF-Token"
+	fieldName  = "csrf_token"
+)
+
+type contextKey struct{}
+
+// double-submit check: state-changing requests echo the csrf cookie in X-CSRF-Token or the csrf_token field
+func Protect(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// caldav clients authenticate with basic auth, not cookies
+		if strings.HasPrefix(r.URL.Path, "/dav/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		token := ""
+		if cookie, err := r.Cookie(cookieName); err == nil && cookie.Value != "" {
+			token = cookie.Value
+		}
+
+		if !safeMethod(r.Method) {
+			sent := r.Header.Get(headerName)
+			if sent == "" {
+				sent = r.FormValue(fieldName)
+			}
+			if token == "" || subtle.ConstantTimeCompare([]byte(sent), []byte(token)) != 1 {
+				http.Error(w, "forbidden: missing or invalid csrf token, reload the page and try again", http.StatusForbidden)
+				return
+			}
+		}
+
+		if token == "" {
+			var err error
+			token, err = auth.GenerateToken()
+			if err != nil {
+				http.Error(w, "failed to create csrf token", http.StatusInternalServerError)
+				return
+			}
+			http.SetCookie(w, &http.Cookie{
+				Name:     cookieName,
+				Value:    token,
+				Path:     "/",
+				HttpOnly: true,
+				SameSite: http.SameSiteLaxMode,
+			})
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), contextKey{}, token)))
+	})
+}
+
+// token for the current request, rendered into pages and htmx headers
+func Token(r *http.Request) string {
+	token, _ := r.Context().Value(contextKey{}).(string)
+	return token
+}
+
+func safeMethod(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,105 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"taskbox/internal/metrics"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+func init() {
+	sql.Register("sqlite3-timed", timedDriver{&sqlite3.SQLiteDriver{}})
+}
+
+// open the sqlite database with every call timed for /metrics
+func Open(path string) (*sql.DB, error) {
+	return sql.Open("sqlite3-timed", path)
+}
+
+// wraps the sqlite3 driver to report query, exec and transaction latency
+type timedDriver struct {
+	driver.Driver
+}
+
+func (d timedDriver) Open(name string) (driver.Conn, error) {
+	conn, err := d.Driver.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &timedConn{conn.(*sqlite3.SQLiteConn)}, nil
+}
+
+type timedConn struct {
+	*sqlite3.SQLiteConn
+}
+
+func (c *timedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	start := time.Now()
+	rows, err := c.SQLiteConn.QueryContext(ctx, query, args)
+	metrics.ObserveQuery("query", start, err)
+	return rows, err
+}
+
+func (c *timedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	start := time.Now()
+	result, err := c.SQLiteConn.ExecContext(ctx, query, args)
+	metrics.ObserveQuery("exec", start, err)
+	return result, err
+}
+
+func (c *timedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	stmt, err := c.SQLiteConn.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return &timedStmt{stmt.(*sqlite3.SQLiteStmt)}, nil
+}
+
+func (c *timedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	start := time.Now()
+	tx, err := c.SQLiteConn.BeginTx(ctx, opts)
+	metrics.ObserveQuery("begin", start, err)
+	if err != nil {
+		return nil, err
+	}
+	return timedTx{tx}, nil
+}
+
+type timedStmt struct {
+	*sqlite3.SQLiteStmt
+}
+
+func (s *timedStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	start := time.Now()
+	rows, err := s.SQLiteStmt.QueryContext(ctx, args)
+	metrics.ObserveQuery("query", start, err)
+	return rows, err
+}
+
+func (s *timedStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	start := time.Now()
+	result, err := s.SQLiteStmt.ExecContext(ctx, args)
+	metrics.ObserveQuery("exec", start, err)
+	return result, err
+}
+
+type timedTx struct {
+	driver.Tx
+}
+
+func (tx timedTx) Commit() error {
+	start := time.Now()
+	err := tx.Tx.Commit()
+	metrics.ObserveQuery("commit", start, err)
+	return err
+}
+
+func (tx timedTx) Rollback() error {
+	start := time.Now()
+	err := tx.Tx.Rollback()
+	metrics.ObserveQuery("rollback", start, err)
+	return err
+}
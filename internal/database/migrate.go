@@ -2,17 +2,100 @@ package database
 
 import (
 	"database/sql"
-	"os"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
 )
 
-func RunMigrations(db *sql.DB) error {
-	// read migration file
-	schema, err := os.ReadFile("migrations/001_initial_schema.sql")
+// run every NNN_*.sql file in fsys not yet recorded in schema_migrations
+func RunMigrations(db *sql.DB, fsys fs.FS) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INTEGER PRIMARY KEY,
+			applied_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
 	if err != nil {
 		return err
 	}
 
-	// execute migration
-	_, err = db.Exec(string(schema))
-	return err
+	files, err := migrationFiles(fsys)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		version, _ := migrationVersion(file)
+
+		var applied int
+		db.QueryRow("SELECT COUNT(*) FROM schema_migrations WHERE version = ?", version).Scan(&applied)
+		if applied > 0 {
+			continue
+		}
+
+		schema, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return err
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(string(schema)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if _, err := tx.Exec("INSERT INTO schema_migrations (version) VALUES (?)", version); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// newest migration applied to db and newest in fsys, equal when the schema is current
+func Versions(db *sql.DB, fsys fs.FS) (applied, latest int, err error) {
+	if err := db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&applied); err != nil {
+		return 0, 0, err
+	}
+
+	files, err := migrationFiles(fsys)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, file := range files {
+		if version, _ := migrationVersion(file); version > latest {
+			latest = version
+		}
+	}
+	return applied, latest, nil
+}
+
+// NNN_*.sql files at the top of fsys, in order
+func migrationFiles(fsys fs.FS) ([]string, error) {
+	matches, err := fs.Glob(fsys, "*.sql")
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(matches)
+
+	files := matches[:0]
+	for _, file := range matches {
+		if _, ok := migrationVersion(file); ok {
+			files = append(files, file)
+		}
+	}
+	return files, nil
+}
+
+func migrationVersion(file string) (int, bool) {
+	version, err := strconv.Atoi(strings.SplitN(path.Base(file), "_", 2)[0])
+	return version, err == nil
 }
@@ -0,0 +1,89 @@
+package events
+
+import "sync"
+
+// server-sent event pushed to open boards
+type Message struct {
+	Event string
+	Data  string
+}
+
+type subscriber struct {
+	ch     chan Message
+	client string
+}
+
+// fans out messages to every open connection of a user
+type Hub struct {
+	mu     sync.Mutex
+	subs   map[int]map[*subscriber]struct{}
+	closed bool
+}
+
+func NewHub() *Hub {
+	return &Hub{subs: make(map[int]map[*subscriber]struct{})}
+}
+
+// register a connection, client identifies the browser tab
+func (h *Hub) Subscribe(userID int, client string) (<-chan Message, func()) {
+	sub := &subscriber{ch: make(chan Message, 16), client: client}
+
+	h.mu.Lock()
+	if h.closed {
+		h.mu.Unlock()
+		close(sub.ch)
+		return sub.ch, func() {}
+	}
+	if h.subs[userID] == nil {
+		h.subs[userID] = make(map[*subscriber]struct{})
+	}
+	h.subs[userID][sub] = struct{}{}
+	h.mu.Unlock()
+
+	return sub.ch, func() {
+		h.mu.Lock()
+		delete(h.subs[userID], sub)
+		if len(h.subs[userID]) == 0 {
+			delete(h.subs, userID)
+		}
+		h.mu.Unlock()
+	}
+}
+
+// send to all of a user's connections except the tab that caused the change
+func (h *Hub) Publish(userID int, origin string, msg Message) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for sub := range h.subs[userID] {
+		if origin != "" && sub.client == origin {
+			continue
+		}
+		// slow connections miss updates rather than block writers
+		select {
+		case sub.ch <- msg:
+		default:
+		}
+	}
+}
+
+// whether the user has any open connection
+func (h *Hub) Connected(userID int) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subs[userID]) > 0
+}
+
+// end every stream by closing its channel, for shutdown
+func (h *Hub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.closed = true
+	for _, subs := range h.subs {
+		for sub := range subs {
+			close(sub.ch)
+		}
+	}
+	h.subs = make(map[int]map[*subscriber]struct{})
+}
@@ -0,0 +1,165 @@
+package handlers
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"strings"
+	"taskbox/internal/auth"
+	"taskbox/internal/csrf"
+	"taskbox/internal/models"
+	"time"
+)
+
+// one row of the admin user list
+type adminUser struct {
+	ID          int
+	Username    string
+	Email       string
+	IsAdmin     bool
+	Disabled    bool
+	TaskCount   int
+	Sessions    int
+	LastActive  *time.Time
+	CreatedAt   time.Time
+	LockedUntil *time.Time
+	TwoFactor   bool
+}
+
+// admin console: GET /admin, POST /admin/users/{id}/{disable,enable,logout,reset-password,reset-2fa,delete}
+func (h *Handler) Admin(w http.ResponseWriter, r *http.Request) {
+	user := h.getCurrentUser(r)
+	if user == nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	if !user.IsAdmin {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin"), "/")
+	if r.Method == "GET" && path == "" {
+		h.renderAdmin(w, r, user, "", "")
+		return
+	}
+
+	parts := strings.Split(path, "/")
+	if r.Method != "POST" || len(parts) != 3 || parts[0] != "users" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := strconv.Atoi(parts[1])
+	if err != nil {
+		http.Error(w, "invalid user id", http.StatusBadRequest)
+		return
+	}
+
+	var username string
+	if err := h.db.QueryRowContext(r.Context(), "SELECT username FROM users WHERE id = ?", id).Scan(&username); err != nil {
+		http.Error(w, "user not found", http.StatusNotFound)
+		return
+	}
+
+	// keep admins from locking themselves out
+	if id == user.ID && (parts[2] == "disable" || parts[2] == "delete") {
+		h.renderAdmin(w, r, user, "you can't "+parts[2]+" your own account", "")
+		return
+	}
+
+	switch parts[2] {
+	case "disable":
+		err = auth.SetDisabled(h.db, id, true)
+		h.adminResult(w, r, user, err, username+" disabled and signed out")
+	case "enable":
+		err = auth.SetDisabled(h.db, id, false)
+		h.adminResult(w, r, user, err, username+" enabled")
+	case "logout":
+		_, err = h.db.ExecContext(r.Context(), "DELETE FROM sessions WHERE user_id = ?", id)
+		h.adminResult(w, r, user, err, username+" signed out everywhere")
+	case "reset-password":
+		var password string
+		password, err = auth.SetTemporaryPassword(h.db, id)
+		h.adminResult(w, r, user, err, "temporary password for "+username+": "+password+" (shown once, ask them to change it)")
+	case "reset-2fa":
+		err = auth.ResetTwoFactor(h.db, username)
+		h.adminResult(w, r, user, err, "two-factor authentication turned off for "+username)
+	case "delete":
+		if r.FormValue("confirm") != username {
+			h.renderAdmin(w, r, user, "type the username to confirm deleting "+username, "")
+			return
+		}
+		err = auth.DeleteUser(h.db, id)
+		h.adminResult(w, r, user, err, username+" and all their data deleted")
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (h *Handler) adminResult(w http.ResponseWriter, r *http.Request, user *models.User, err error, notice string) {
+	if err != nil {
+		http.Error(w, "admin action failed", http.StatusInternalServerError)
+		return
+	}
+	h.renderAdmin(w, r, user, "", notice)
+}
+
+func (h *Handler) renderAdmin(w http.ResponseWriter, r *http.Request, user *models.User, errMsg, notice string) {
+	rows, err := h.db.QueryContext(r.Context(), `
+		SELECT
+			u.id, u.username, COALESCE(u.email, ''), u.is_admin, u.disabled_at IS NOT NULL,
+			u.totp_enabled_at IS NOT NULL, u.locked_until, u.created_at,
+			(SELECT COUNT(*) FROM tasks t WHERE t.user_id = u.id),
+			(SELECT COUNT(*) FROM sessions s WHERE s.user_id = u.id AND s.expires_at > CURRENT_TIMESTAMP),
+			(SELECT MAX(s.last_seen_at) FROM sessions s WHERE s.user_id = u.id)
+		FROM users u
+		ORDER BY u.username
+	`)
+	if err != nil {
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	users := []adminUser{}
+	for rows.Next() {
+		var u adminUser
+		var lockedUntil sql.NullTime
+		var lastActive sql.NullString
+		err := rows.Scan(
+			&u.ID,
+			&u.Username,
+			&u.Email,
+			&u.IsAdmin,
+			&u.Disabled,
+			&u.TwoFactor,
+			&lockedUntil,
+			&u.CreatedAt,
+			&u.TaskCount,
+			&u.Sessions,
+			&lastActive,
+		)
+		if err != nil {
+			continue
+		}
+		if lockedUntil.Valid && lockedUntil.Time.After(time.Now()) {
+			u.LockedUntil = &lockedUntil.Time
+		}
+		// MAX() loses the column type, so parse the sqlite timestamp by hand
+		if lastActive.Valid {
+			if t, err := time.Parse("2006-01-02 15:04:05", lastActive.String); err == nil {
+				u.LastActive = &t
+			}
+		}
+		users = append(users, u)
+	}
+
+	h.render(w, r, "admin.html", map[string]interface{}{
+		"User":      user,
+		"Users":     users,
+		"Error":     errMsg,
+		"Notice":    notice,
+		"DevMode":   h.devMode,
+		"CSRFToken": csrf.Token(r),
+	})
+}
@@ -1,46 +1,85 @@
 package handlers
 
 import (
+	"errors"
+	"fmt"
+	"math"
 	"net/http"
+	"strings"
 	"taskbox/internal/auth"
+	"taskbox/internal/csrf"
+	"taskbox/internal/models"
+	"taskbox/internal/ratelimit"
+	"time"
 )
 
 func (h *Handler) Register(w http.ResponseWriter, r *http.Request) {
+	// accounts come from the identity provider when passwords are off
+	if !h.passwordLogin {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
 	if r.Method == "GET" {
-		h.templates.ExecuteTemplate(w, "register.html", map[string]interface{}{
-			"DevMode": h.devMode,
-		})
+		h.renderRegister(w, r, "")
 		return
 	}
 
 	// handle POST
-	username := r.FormValue("username")
+	if h.registration == auth.RegistrationClosed {
+		w.WriteHeader(http.StatusForbidden)
+		h.renderRegister(w, r, "")
+		return
+	}
+
+	if wait, ok := h.registrations.Allow(auth.ClientIP(r)); !ok {
+		ratelimit.SetRetryAfter(w, wait)
+		w.WriteHeader(http.StatusTooManyRequests)
+		h.renderRegister(w, r, "too many registrations, try again in "+waitText(wait))
+		return
+	}
+
+	username := strings.TrimSpace(r.FormValue("username"))
 	password := r.FormValue("password")
 
 	if username == "" || password == "" {
-		h.templates.ExecuteTemplate(w, "register.html", map[string]interface{}{
-			"Error":   "username and password required",
-			"DevMode": h.devMode,
-		})
+		h.renderRegister(w, r, "username and password required")
+		return
+	}
+	if err := auth.ValidateUsername(username); err != nil {
+		h.renderRegister(w, r, err.Error())
+		return
+	}
+	if err := auth.CheckPasswordPolicy(password, username); err != nil {
+		h.renderRegister(w, r, err.Error())
 		return
 	}
 
-	user, err := auth.CreateUser(h.db, username, password)
+	var user *models.User
+	var err error
+	if h.registration == auth.RegistrationInvite {
+		user, err = auth.RegisterWithInvite(h.db, username, password, r.FormValue("invite"))
+	} else {
+		user, err = auth.CreateUser(h.db, username, password)
+	}
+	if errors.Is(err, auth.ErrInvalidInvite) {
+		h.renderRegister(w, r, "that invite code is invalid, used up or expired")
+		return
+	}
 	if err != nil {
-		h.templates.ExecuteTemplate(w, "register.html", map[string]interface{}{
-			"Error":   "username already exists",
-			"DevMode": h.devMode,
-		})
+		h.renderRegister(w, r, "username already exists")
 		return
 	}
 
+	// rotate: drop any session the browser already carried
+	if old := auth.GetSessionToken(r); old != "" {
+		auth.DeleteSession(h.db, old)
+	}
+
 	// create session
-	token, err := auth.CreateSession(h.db, user.ID)
+	token, err := auth.CreateSession(h.db, user.ID, auth.ClientIP(r), r.UserAgent())
 	if err != nil {
-		h.templates.ExecuteTemplate(w, "register.html", map[string]interface{}{
-			"Error":   "failed to create session",
-			"DevMode": h.devMode,
-		})
+		h.renderRegister(w, r, "failed to create session")
 		return
 	}
 
@@ -48,34 +87,89 @@ func (h *Handler) Register(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
+func (h *Handler) renderRegister(w http.ResponseWriter, r *http.Request, errMsg string) {
+	data := map[string]interface{}{
+		"Error":     errMsg,
+		"Mode":      h.registration,
+		"Invite":    r.FormValue("invite"),
+		"Username":  r.FormValue("username"),
+		"DevMode":   h.devMode,
+		"CSRFToken": csrf.Token(r),
+	}
+	if h.sso != nil {
+		data["SSOName"] = h.sso.Name
+	}
+	h.render(w, r, "register.html", data)
+}
+
 func (h *Handler) Login(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "GET" {
-		h.templates.ExecuteTemplate(w, "login.html", map[string]interface{}{
-			"DevMode": h.devMode,
-		})
+		h.renderLogin(w, r, "", "")
 		return
 	}
 
 	// handle POST
+	if !h.passwordLogin {
+		w.WriteHeader(http.StatusForbidden)
+		h.renderLogin(w, r, "password login is disabled, use single sign-on", "")
+		return
+	}
+
 	username := r.FormValue("username")
 	password := r.FormValue("password")
+	ip := auth.ClientIP(r)
+
+	// back off per address and per account before touching the hash, throttled requests aren't audited
+	wait := max(h.loginIPs.Wait(ip), h.loginUsers.Wait(username))
+	if wait > 0 {
+		h.loginThrottled(w, r, wait, "too many attempts, try again in "+waitText(wait))
+		return
+	}
 
 	user, err := auth.AuthenticateUser(h.db, username, password)
+	// the same answer whatever the password, and guesses don't extend the lock
+	if errors.Is(err, auth.ErrLocked) {
+		wait := auth.LockedFor(h.db, username)
+		h.loginThrottled(w, r, wait, "account locked after too many failed attempts, try again in "+waitText(wait))
+		return
+	}
+	if errors.Is(err, auth.ErrDisabled) {
+		w.WriteHeader(http.StatusForbidden)
+		h.renderLogin(w, r, "this account has been disabled, contact an administrator", "")
+		return
+	}
 	if err != nil {
-		h.templates.ExecuteTemplate(w, "login.html", map[string]interface{}{
-			"Error":   "invalid credentials",
-			"DevMode": h.devMode,
-		})
+		h.loginIPs.Hit(ip)
+		h.loginUsers.Hit(username)
+		auth.RecordFailedLogin(h.db, username, ip, r.UserAgent(), auth.ReasonBadPassword)
+		h.renderLogin(w, r, "invalid credentials", "")
 		return
 	}
 
+	// rotate: drop any session the browser already carried
+	if old := auth.GetSessionToken(r); old != "" {
+		auth.DeleteSession(h.db, old)
+	}
+
+	// park the login in a pending session until the second factor checks out
+	if auth.TwoFactorEnabled(h.db, user.ID) {
+		token, err := auth.CreatePendingSession(h.db, user.ID, ip, r.UserAgent())
+		if err != nil {
+			http.Error(w, "failed to create session", http.StatusInternalServerError)
+			return
+		}
+		auth.SetSessionCookie(w, token)
+		http.Redirect(w, r, "/login/2fa", http.StatusSeeOther)
+		return
+	}
+
+	h.loginUsers.Reset(username)
+	auth.ResetFailedLogins(h.db, user.ID)
+
 	// create session
-	token, err := auth.CreateSession(h.db, user.ID)
+	token, err := auth.CreateSession(h.db, user.ID, auth.ClientIP(r), r.UserAgent())
 	if err != nil {
-		h.templates.ExecuteTemplate(w, "login.html", map[string]interface{}{
-			"Error":   "failed to create session",
-			"DevMode": h.devMode,
-		})
+		h.renderLogin(w, r, "failed to create session", "")
 		return
 	}
 
@@ -83,7 +177,46 @@ func (h *Handler) Login(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
+func (h *Handler) loginThrottled(w http.ResponseWriter, r *http.Request, wait time.Duration, msg string) {
+	ratelimit.SetRetryAfter(w, wait)
+	w.WriteHeader(http.StatusTooManyRequests)
+	h.renderLogin(w, r, msg, "")
+}
+
+func (h *Handler) renderLogin(w http.ResponseWriter, r *http.Request, errMsg, notice string) {
+	data := map[string]interface{}{
+		"Error":         errMsg,
+		"Notice":        notice,
+		"PasswordLogin": h.passwordLogin,
+		"Registration":  h.registration != auth.RegistrationClosed,
+		"ResetEnabled":  h.mailer != nil && h.passwordLogin,
+		"DevMode":       h.devMode,
+		"CSRFToken":     csrf.Token(r),
+	}
+	if h.sso != nil {
+		data["SSOName"] = h.sso.Name
+	}
+	h.render(w, r, "login.html", data)
+}
+
+// rough human wait, e.g. "40 seconds" or "3 minutes"
+func waitText(d time.Duration) string {
+	n, unit := int(math.Ceil(d.Seconds())), "second"
+	if d >= time.Minute {
+		n, unit = int(math.Ceil(d.Minutes())), "minute"
+	}
+	if n != 1 {
+		unit += "s"
+	}
+	return fmt.Sprintf("%d %s", n, unit)
+}
+
 func (h *Handler) Logout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
 	token := auth.GetSessionToken(r)
 	if token != "" {
 		auth.DeleteSession(h.db, token)
@@ -0,0 +1,636 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"taskbox/internal/calendar"
+	"taskbox/internal/models"
+	"time"
+)
+
+// task as exposed to caldav clients
+type davObject struct {
+	Task models.Task
+	UID  string
+	Name string
+	Data []byte
+	ETag string
+}
+
+// multistatus response body, prefixes are declared on the root element
+type davMultistatus struct {
+	XMLName   xml.Name      `xml:"D:multistatus"`
+	XmlnsD    string        `xml:"xmlns:D,attr"`
+	XmlnsC    string        `xml:"xmlns:C,attr"`
+	XmlnsCS   string        `xml:"xmlns:CS,attr"`
+	Responses []davResponse `xml:"D:response"`
+}
+
+type davResponse struct {
+	Href     string        `xml:"D:href"`
+	Propstat []davPropstat `xml:"D:propstat,omitempty"`
+	Status   string        `xml:"D:status,omitempty"`
+}
+
+type davPropstat struct {
+	Prop   davProp `xml:"D:prop"`
+	Status string  `xml:"D:status"`
+}
+
+type davProp struct {
+	ResourceType         *davResourceType `xml:"D:resourcetype,omitempty"`
+	DisplayName          string           `xml:"D:displayname,omitempty"`
+	CurrentUserPrincipal *davHref         `xml:"D:current-user-principal,omitempty"`
+	PrincipalURL         *davHref         `xml:"D:principal-URL,omitempty"`
+	Owner                *davHref         `xml:"D:owner,omitempty"`
+	CalendarHomeSet      *davHref         `xml:"C:calendar-home-set,omitempty"`
+	ComponentSet         *davCompSet      `xml:"C:supported-calendar-component-set,omitempty"`
+	ReportSet            *davReportSet    `xml:"D:supported-report-set,omitempty"`
+	PrivilegeSet         *davPrivilegeSet `xml:"D:current-user-privilege-set,omitempty"`
+	CTag                 string           `xml:"CS:getctag,omitempty"`
+	ETag                 string           `xml:"D:getetag,omitempty"`
+	ContentType          string           `xml:"D:getcontenttype,omitempty"`
+	CalendarData         string           `xml:"C:calendar-data,omitempty"`
+}
+
+type davHref struct {
+	Href string `xml:"D:href"`
+}
+
+type davResourceType struct {
+	Collection *struct{} `xml:"D:collection,omitempty"`
+	Calendar   *struct{} `xml:"C:calendar,omitempty"`
+	Principal  *struct{} `xml:"D:principal,omitempty"`
+}
+
+type davCompSet struct {
+	Comp []davComp `xml:"C:comp"`
+}
+
+type davComp struct {
+	Name string `xml:"name,attr"`
+}
+
+type davReportSet struct {
+	Reports []davReport `xml:"D:supported-report"`
+}
+
+type davReport struct {
+	Report davReportName `xml:"D:report"`
+}
+
+type davReportName struct {
+	Query    *struct{} `xml:"C:calendar-query,omitempty"`
+	Multiget *struct{} `xml:"C:calendar-multiget,omitempty"`
+}
+
+type davPrivilegeSet struct {
+	Privileges []davPrivilege `xml:"D:privilege"`
+}
+
+type davPrivilege struct {
+	Read  *struct{} `xml:"D:read,omitempty"`
+	Write *struct{} `xml:"D:write,omitempty"`
+}
+
+// collection names shown in clients
+var davDisplayNames = map[string]string{
+	"inbox":    "Inbox",
+	"do":       "Do",
+	"decide":   "Decide",
+	"delegate": "Delegate",
+	"delete":   "Delete",
+	"archive":  "Done",
+}
+
+const davStatusOK = "HTTP/1.1 200 OK"
+
+func (h *Handler) davPropfind(w http.ResponseWriter, r *http.Request, user *models.User, parts []string, position, name string) {
+	depth := r.Header.Get("Depth")
+	children := depth == "1" || strings.EqualFold(depth, "infinity")
+
+	responses := []davResponse{}
+	switch len(parts) {
+	case 0:
+		// principal
+		responses = append(responses, davResponse{
+			Href: "/dav/",
+			Propstat: []davPropstat{{Status: davStatusOK, Prop: davProp{
+				ResourceType:         &davResourceType{Collection: &struct{}{}, Principal: &struct{}{}},
+				DisplayName:          user.Username,
+				CurrentUserPrincipal: &davHref{"/dav/"},
+				PrincipalURL:         &davHref{"/dav/"},
+				CalendarHomeSet:      &davHref{"/dav/calendars/"},
+			}}},
+		})
+	case 1:
+		// calendar home
+		responses = append(responses, davResponse{
+			Href: "/dav/calendars/",
+			Propstat: []davPropstat{{Status: davStatusOK, Prop: davProp{
+				ResourceType:         &davResourceType{Collection: &struct{}{}},
+				CurrentUserPrincipal: &davHref{"/dav/"},
+				Owner:                &davHref{"/dav/"},
+			}}},
+		})
+		if children {
+			for _, position := range models.Positions {
+				objects, err := h.davObjects(r, user.ID, position, "")
+				if err != nil {
+					http.Error(w, "database error", http.StatusInternalServerError)
+					return
+				}
+				responses = append(responses, davCalendarResponse(position, objects))
+			}
+		}
+	case 2:
+		objects, err := h.davObjects(r, user.ID, position, "")
+		if err != nil {
+			http.Error(w, "database error", http.StatusInternalServerError)
+			return
+		}
+		responses = append(responses, davCalendarResponse(position, objects))
+		if children {
+			for _, object := range objects {
+				responses = append(responses, davObjectResponse(position, object, false))
+			}
+		}
+	case 3:
+		objects, err := h.davObjects(r, user.ID, position, name)
+		if err != nil {
+			http.Error(w, "database error", http.StatusInternalServerError)
+			return
+		}
+		if len(objects) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+		responses = append(responses, davObjectResponse(position, objects[0], false))
+	}
+
+	writeMultistatus(w, responses)
+}
+
+func (h *Handler) davReport(w http.ResponseWriter, r *http.Request, user *models.User, position string) {
+	// collect element names and hrefs from the request body
+	var report string
+	elements := map[string]bool{}
+	hrefs := []string{}
+	decoder := xml.NewDecoder(io.LimitReader(r.Body, 1<<20))
+	inHref := false
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			break
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			if report == "" {
+				report = t.Name.Local
+			}
+			elements[t.Name.Local] = true
+			inHref = t.Name.Local == "href"
+		case xml.EndElement:
+			inHref = false
+		case xml.CharData:
+			if inHref {
+				hrefs = append(hrefs, strings.TrimSpace(string(t)))
+			}
+		}
+	}
+	withData := elements["calendar-data"]
+
+	responses := []davResponse{}
+	switch report {
+	case "calendar-query":
+		objects, err := h.davObjects(r, user.ID, position, "")
+		if err != nil {
+			http.Error(w, "database error", http.StatusInternalServerError)
+			return
+		}
+		for _, object := range objects {
+			responses = append(responses, davObjectResponse(position, object, withData))
+		}
+	case "calendar-multiget":
+		for _, href := range hrefs {
+			if u, err := url.Parse(href); err == nil {
+				href = u.Path
+			}
+			dir, name := path.Split(href)
+			if strings.Trim(dir, "/") != "dav/calendars/"+position {
+				responses = append(responses, davResponse{Href: href, Status: "HTTP/1.1 404 Not Found"})
+				continue
+			}
+
+			objects, err := h.davObjects(r, user.ID, position, name)
+			if err != nil {
+				http.Error(w, "database error", http.StatusInternalServerError)
+				return
+			}
+			if len(objects) == 0 {
+				responses = append(responses, davResponse{Href: href, Status: "HTTP/1.1 404 Not Found"})
+				continue
+			}
+			responses = append(responses, davObjectResponse(position, objects[0], withData))
+		}
+	default:
+		http.Error(w, "unsupported report", http.StatusForbidden)
+		return
+	}
+
+	writeMultistatus(w, responses)
+}
+
+func (h *Handler) davGet(w http.ResponseWriter, r *http.Request, user *models.User, position, name string) {
+	objects, err := h.davObjects(r, user.ID, position, name)
+	if err != nil {
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	if len(objects) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("ETag", objects[0].ETag)
+	if r.Method == "HEAD" {
+		return
+	}
+	w.Write(objects[0].Data)
+}
+
+func (h *Handler) davPut(w http.ResponseWriter, r *http.Request, user *models.User, position, name string) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, "failed to read body", http.StatusBadRequest)
+		return
+	}
+
+	todo, err := calendar.ParseTodo(body)
+	if err != nil {
+		http.Error(w, "only VTODO objects are supported", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	objects, err := h.davObjects(r, user.ID, position, name)
+	if err != nil {
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+
+	// the task this put writes: the object at the href, or the task holding the uid when it moves in from another collection
+	taskID, current := 0, ""
+	if len(objects) > 0 {
+		taskID, current = objects[0].Task.ID, objects[0].ETag
+	}
+	if todo.UID != "" {
+		var uidTask, version int
+		err := h.db.QueryRowContext(r.Context(), `
+			SELECT id, version FROM tasks
+			WHERE user_id = ? AND (ical_uid = ? OR (ical_uid IS NULL AND 'task-' || id || '@gridwork' = ?))
+		`, user.ID, todo.UID, todo.UID).Scan(&uidTask, &version)
+		switch {
+		case err != nil:
+		case taskID == 0:
+			taskID, current = uidTask, davETag(uidTask, version)
+		case uidTask != taskID:
+			http.Error(w, "uid belongs to another object", http.StatusConflict)
+			return
+		}
+	}
+
+	// conflict detection against the current etag of that task, moves included
+	ifMatch := r.Header.Get("If-Match")
+	ifNoneMatch := r.Header.Get("If-None-Match")
+	if taskID == 0 && ifMatch != "" {
+		http.Error(w, "object no longer exists", http.StatusPreconditionFailed)
+		return
+	}
+	if taskID != 0 {
+		if ifNoneMatch == "*" || (ifMatch != "" && ifMatch != "*" && ifMatch != current) {
+			http.Error(w, "object was modified", http.StatusPreconditionFailed)
+			return
+		}
+	}
+
+	// completion maps to the archive while the object stays in this collection, reopening returns it to where it was
+	newPosition := position
+	if todo.Completed {
+		newPosition = "archive"
+	} else if position == "archive" {
+		var previous sql.NullString
+		h.db.QueryRowContext(r.Context(), "SELECT previous_position FROM tasks WHERE id = ?", taskID).Scan(&previous)
+		newPosition = "inbox"
+		if previous.Valid && previous.String != "archive" && slices.Contains(models.Positions, previous.String) {
+			newPosition = previous.String
+		}
+	}
+
+	title := todo.Summary
+	if title == "" {
+		title = "untitled"
+	}
+	var dueDate interface{}
+	if todo.Due != nil {
+		dueDate = todo.Due.Format("2006-01-02")
+	}
+	var tags interface{}
+	if len(todo.Categories) > 0 {
+		tagsJSON, _ := json.Marshal(todo.Categories)
+		tags = string(tagsJSON)
+	}
+	var uid interface{}
+	if todo.UID != "" {
+		uid = todo.UID
+	}
+
+	if taskID == 0 {
+		var maxOrder int
+		h.db.QueryRowContext(r.Context(), `
+			SELECT COALESCE(MAX(matrix_order), -1)
+			FROM tasks
+			WHERE user_id = ? AND position = ?
+		`, user.ID, newPosition).Scan(&maxOrder)
+
+		result, err := h.db.ExecContext(r.Context(), `
+			INSERT INTO tasks (user_id, title, description, due_date, tags, position, matrix_order, ical_uid, dav_name, updated_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, CURRENT_TIMESTAMP)
+		`, user.ID, title, todo.Description, dueDate, tags, newPosition, maxOrder+1, uid, name)
+		if err != nil {
+			http.Error(w, "failed to create task", http.StatusInternalServerError)
+			return
+		}
+
+		newID, _ := result.LastInsertId()
+		h.webhooks.TaskCreated(user.ID, newID, title, newPosition)
+		h.broadcast(r, user.ID, eventTaskCreated, newPosition)
+		h.davSetETag(w, r, int(newID))
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+
+	// keep the matrix order unless the task changes position
+	var currentPosition string
+	var order int
+	var old struct{ title, description, dueDate, tags string }
+	h.db.QueryRowContext(r.Context(), `
+		SELECT position, matrix_order, title, COALESCE(description, ''), COALESCE(due_date, ''), COALESCE(tags, '')
+		FROM tasks WHERE id = ?
+	`, taskID).Scan(&currentPosition, &order, &old.title, &old.description, &old.dueDate, &old.tags)
+	if currentPosition != newPosition {
+		h.db.QueryRowContext(r.Context(), `
+			SELECT COALESCE(MAX(matrix_order), -1) + 1
+			FROM tasks
+			WHERE user_id = ? AND position = ?
+		`, user.ID, newPosition).Scan(&order)
+	}
+
+	// written into the archive collection, a task stays there instead of showing up under its previous position
+	_, err = h.db.ExecContext(r.Context(), `
+		UPDATE tasks
+		SET title = ?, description = ?, due_date = ?, tags = ?, position = ?, matrix_order = ?,
+			previous_position = CASE
+				WHEN ? THEN NULL
+				WHEN ? = 'archive' AND position != 'archive' THEN position
+				ELSE previous_position
+			END,
+			ical_uid = COALESCE(?, ical_uid), dav_name = ?, version = version + 1, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ? AND user_id = ?
+	`, title, todo.Description, dueDate, tags, newPosition, order, position == "archive", newPosition, uid, name, taskID, user.ID)
+	if err != nil {
+		http.Error(w, "failed to update task", http.StatusInternalServerError)
+		return
+	}
+
+	// a put replaces the whole task, webhooks only hear about what differs
+	changed := []string{}
+	if title != old.title {
+		changed = append(changed, "title")
+	}
+	if todo.Description != old.description {
+		changed = append(changed, "description")
+	}
+	// stored due dates may carry a time, caldav only sends the day
+	if newDue, _ := dueDate.(string); !strings.HasPrefix(old.dueDate, newDue) || (newDue == "") != (old.dueDate == "") {
+		changed = append(changed, "due_date")
+	}
+	if newTags, _ := tags.(string); newTags != old.tags {
+		changed = append(changed, "tags")
+	}
+	h.webhooks.TaskChanged(user.ID, taskID, currentPosition, newPosition, changed)
+
+	if currentPosition != newPosition {
+		h.broadcast(r, user.ID, eventTaskMoved, currentPosition, newPosition)
+	} else {
+		h.broadcast(r, user.ID, eventTaskUpdated, newPosition)
+	}
+
+	h.davSetETag(w, r, taskID)
+	if len(objects) == 0 {
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// etag of the stored object, so clients don't have to fetch what they just wrote
+func (h *Handler) davSetETag(w http.ResponseWriter, r *http.Request, taskID int) {
+	var version int
+	if h.db.QueryRowContext(r.Context(), "SELECT version FROM tasks WHERE id = ?", taskID).Scan(&version) == nil {
+		w.Header().Set("ETag", davETag(taskID, version))
+	}
+}
+
+// every stored change bumps the version, so the etag doesn't depend on how the object is rendered
+func davETag(taskID, version int) string {
+	return `"` + strconv.Itoa(taskID) + "-" + strconv.Itoa(version) + `"`
+}
+
+// collection a task shows up in: completed tasks stay where they were completed, the archive holds the rest
+var davCollection = func() string {
+	var open []string
+	for _, p := range models.Positions {
+		if p != "archive" {
+			open = append(open, "'"+p+"'")
+		}
+	}
+	return "CASE WHEN position = 'archive' AND previous_position IN (" + strings.Join(open, ", ") + ") THEN previous_position ELSE position END"
+}()
+
+func (h *Handler) davDelete(w http.ResponseWriter, r *http.Request, user *models.User, position, name string) {
+	objects, err := h.davObjects(r, user.ID, position, name)
+	if err != nil {
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	if len(objects) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" && ifMatch != "*" && ifMatch != objects[0].ETag {
+		http.Error(w, "object was modified", http.StatusPreconditionFailed)
+		return
+	}
+
+	_, err = h.db.ExecContext(r.Context(), "DELETE FROM tasks WHERE id = ? AND user_id = ?", objects[0].Task.ID, user.ID)
+	if err != nil {
+		http.Error(w, "failed to delete task", http.StatusInternalServerError)
+		return
+	}
+
+	h.webhooks.TaskDeleted(user.ID, objects[0].Task.ID)
+	h.broadcast(r, user.ID, eventTaskDeleted, position)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// load tasks in a position, optionally filtered to one object name
+func (h *Handler) davObjects(r *http.Request, userID int, position, name string) ([]davObject, error) {
+	query := `
+		SELECT id, title, description, due_date, tags, position, matrix_order, created_at, updated_at, ical_uid, dav_name, version
+		FROM tasks
+		WHERE user_id = ? AND ` + davCollection + ` = ?
+	`
+	args := []interface{}{userID, position}
+	if name != "" {
+		query += " AND (dav_name = ? OR (dav_name IS NULL AND 'task-' || id || '.ics' = ?))"
+		args = append(args, name, name)
+	}
+	query += " ORDER BY matrix_order, id"
+
+	rows, err := h.db.QueryContext(r.Context(), query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	base := baseURL(r)
+	objects := []davObject{}
+	for rows.Next() {
+		var task models.Task
+		var tagsJSON sql.NullString
+		var dueDateStr sql.NullString
+		var description sql.NullString
+		var uid sql.NullString
+		var davName sql.NullString
+
+		err := rows.Scan(
+			&task.ID,
+			&task.Title,
+			&description,
+			&dueDateStr,
+			&tagsJSON,
+			&task.Position,
+			&task.MatrixOrder,
+			&task.CreatedAt,
+			&task.UpdatedAt,
+			&uid,
+			&davName,
+			&task.Version,
+		)
+		if err != nil {
+			continue
+		}
+
+		task.UserID = userID
+		if description.Valid {
+			task.Description = description.String
+		}
+		if dueDateStr.Valid {
+			t, _ := time.Parse(time.RFC3339, dueDateStr.String)
+			task.DueDate = &t
+		}
+		if tagsJSON.Valid && tagsJSON.String != "" {
+			json.Unmarshal([]byte(tagsJSON.String), &task.Tags)
+		}
+
+		object := davObject{
+			Task: task,
+			UID:  calendar.TaskUID(task.ID),
+			Name: "task-" + strconv.Itoa(task.ID) + ".ics",
+		}
+		if uid.Valid && uid.String != "" {
+			object.UID = uid.String
+		}
+		if davName.Valid && davName.String != "" {
+			object.Name = davName.String
+		}
+		object.Data = calendar.RenderTodo(task, object.UID, base)
+		object.ETag = davETag(task.ID, task.Version)
+
+		objects = append(objects, object)
+	}
+
+	return objects, nil
+}
+
+func davCalendarResponse(position string, objects []davObject) davResponse {
+	// ctag changes whenever any object in the collection changes
+	hash := sha256.New()
+	for _, object := range objects {
+		hash.Write([]byte(object.Name + object.ETag))
+	}
+
+	return davResponse{
+		Href: "/dav/calendars/" + position + "/",
+		Propstat: []davPropstat{{Status: davStatusOK, Prop: davProp{
+			ResourceType: &davResourceType{Collection: &struct{}{}, Calendar: &struct{}{}},
+			DisplayName:  davDisplayNames[position],
+			Owner:        &davHref{"/dav/"},
+			ComponentSet: &davCompSet{Comp: []davComp{{Name: "VTODO"}}},
+			ReportSet: &davReportSet{Reports: []davReport{
+				{Report: davReportName{Query: &struct{}{}}},
+				{Report: davReportName{Multiget: &struct{}{}}},
+			}},
+			PrivilegeSet: &davPrivilegeSet{Privileges: []davPrivilege{
+				{Read: &struct{}{}},
+				{Write: &struct{}{}},
+			}},
+			CTag: hex.EncodeToString(hash.Sum(nil)[:16]),
+		}}},
+	}
+}
+
+func davObjectResponse(position string, object davObject, withData bool) davResponse {
+	prop := davProp{
+		ETag:        object.ETag,
+		ContentType: "text/calendar; charset=utf-8; component=VTODO",
+	}
+	if withData {
+		prop.CalendarData = string(object.Data)
+	}
+
+	return davResponse{
+		Href:     "/dav/calendars/" + position + "/" + url.PathEscape(object.Name),
+		Propstat: []davPropstat{{Status: davStatusOK, Prop: prop}},
+	}
+}
+
+func writeMultistatus(w http.ResponseWriter, responses []davResponse) {
+	body, err := xml.Marshal(davMultistatus{
+		XmlnsD:    "DAV:",
+		XmlnsC:    "urn:ietf:params:xml:ns:caldav",
+		XmlnsCS:   "http://calendarserver.org/ns/",
+		Responses: responses,
+	})
+	if err != nil {
+		http.Error(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(http.StatusMultiStatus)
+	w.Write([]byte(xml.Header))
+	w.Write(body)
+}
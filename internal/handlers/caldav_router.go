@@ -0,0 +1,108 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"taskbox/internal/auth"
+	"taskbox/internal/models"
+)
+
+// caldav entry point: /dav/, /dav/calendars/{position}/, /dav/calendars/{position}/{name}.ics
+func (h *Handler) CalDAV(w http.ResponseWriter, r *http.Request) {
+	user := h.davUser(r)
+	if user == nil {
+		w.Header().Set("WWW-Authenticate", `Basic realm="Gridwork", charset="UTF-8"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// split path into collection position and object name
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/dav"), "/"), "/")
+	if parts[0] == "" {
+		parts = nil
+	}
+	if len(parts) > 0 && parts[0] != "calendars" || len(parts) > 3 {
+		http.NotFound(w, r)
+		return
+	}
+	position, name := "", ""
+	if len(parts) > 1 {
+		position = parts[1]
+		if !slices.Contains(models.Positions, position) {
+			http.NotFound(w, r)
+			return
+		}
+	}
+	if len(parts) > 2 {
+		name = parts[2]
+	}
+
+	switch r.Method {
+	case "OPTIONS":
+		w.Header().Set("DAV", "1, 3, calendar-access")
+		w.Header().Set("Allow", "OPTIONS, GET, HEAD, PUT, DELETE, PROPFIND, REPORT")
+		w.WriteHeader(http.StatusOK)
+	case "PROPFIND":
+		h.davPropfind(w, r, user, parts, position, name)
+	case "REPORT":
+		if position == "" || name != "" {
+			http.Error(w, "report only supported on calendars", http.StatusForbidden)
+			return
+		}
+		h.davReport(w, r, user, position)
+	case "GET", "HEAD":
+		if name == "" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		h.davGet(w, r, user, position, name)
+	case "PUT":
+		if name == "" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		h.davPut(w, r, user, position, name)
+	case "DELETE":
+		if name == "" {
+			http.Error(w, "calendars cannot be deleted", http.StatusForbidden)
+			return
+		}
+		h.davDelete(w, r, user, position, name)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// authenticate caldav clients with http basic auth
+func (h *Handler) davUser(r *http.Request) *models.User {
+	username, password, ok := r.BasicAuth()
+	if !ok || !h.passwordLogin {
+		return nil
+	}
+
+	// same throttles and lockout as the login form
+	ip := auth.ClientIP(r)
+	if h.loginIPs.Wait(ip) > 0 || h.loginUsers.Wait(username) > 0 {
+		return nil
+	}
+
+	user, err := h.davCredentials.Authenticate(h.db, username, password)
+	if errors.Is(err, auth.ErrLocked) || errors.Is(err, auth.ErrDisabled) {
+		return nil
+	}
+	if err != nil {
+		h.loginIPs.Hit(ip)
+		h.loginUsers.Hit(username)
+		auth.RecordFailedLogin(h.db, username, ip, r.UserAgent(), auth.ReasonBadPassword)
+		return nil
+	}
+
+	// basic auth can't carry a second factor, so 2fa accounts are refused
+	if auth.TwoFactorEnabled(h.db, user.ID) {
+		return nil
+	}
+
+	return user
+}
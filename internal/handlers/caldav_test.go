@@ -0,0 +1,346 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"taskbox"
+	"taskbox/internal/auth"
+	"taskbox/internal/config"
+	"taskbox/internal/database"
+	"taskbox/internal/events"
+	"taskbox/internal/webhooks"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-ical"
+	"github.com/emersion/go-webdav"
+	"github.com/emersion/go-webdav/caldav"
+)
+
+// sends the test's conditional headers and remembers the last status
+type davTestClient struct {
+	header http.Header
+	status int
+}
+
+func (c *davTestClient) Do(req *http.Request) (*http.Response, error) {
+	for key, values := range c.header {
+		req.Header[key] = values
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if resp != nil {
+		c.status = resp.StatusCode
+	}
+	return resp, err
+}
+
+// a migrated database holding alice
+func davTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	// cheap hashes, every request checks the password
+	params := auth.Argon2
+	auth.Argon2 = auth.Argon2Params{Memory: 64, Time: 1, Threads: 1, SaltLen: 16, KeyLen: 32}
+	t.Cleanup(func() { auth.Argon2 = params })
+
+	db, err := database.Open(filepath.Join(t.TempDir(), "taskbox.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	assets := taskbox.EmbeddedAssets()
+	if err := database.RunMigrations(db, assets.Migrations); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := auth.CreateUser(db, "alice", "correct horse battery"); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// a caldav client signed in as a fresh user against the handler over httptest, and the database behind it
+func newDAVTest(t *testing.T) (*caldav.Client, *davTestClient, *sql.DB) {
+	t.Helper()
+
+	db := davTestDB(t)
+	cfg := config.Default()
+	h := New(db, &cfg, taskbox.EmbeddedAssets(), webhooks.NewDispatcher(db), events.NewHub(), nil, nil)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/dav/", h.CalDAV)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	hc := &davTestClient{header: http.Header{}}
+	client, err := caldav.NewClient(webdav.HTTPClientWithBasicAuth(hc, "alice", "correct horse battery"), server.URL+"/dav/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, hc, db
+}
+
+func davTodo(uid, summary string, completed bool) *ical.Calendar {
+	todo := ical.NewComponent(ical.CompToDo)
+	todo.Props.SetText(ical.PropUID, uid)
+	todo.Props.SetText(ical.PropSummary, summary)
+	todo.Props.SetDateTime(ical.PropDateTimeStamp, time.Now().UTC())
+	if completed {
+		todo.Props.SetText(ical.PropStatus, "COMPLETED")
+	}
+
+	cal := ical.NewCalendar()
+	cal.Props.SetText(ical.PropVersion, "2.0")
+	cal.Props.SetText(ical.PropProductID, "-//taskbox//test//EN")
+	cal.Children = append(cal.Children, todo)
+	return cal
+}
+
+func davQuery(t *testing.T, client *caldav.Client, position string) []caldav.CalendarObject {
+	t.Helper()
+	objects, err := client.QueryCalendar(context.Background(), "/dav/calendars/"+position+"/", &caldav.CalendarQuery{
+		CompRequest: caldav.CalendarCompRequest{Name: "VCALENDAR", AllProps: true, AllComps: true},
+		CompFilter:  caldav.CompFilter{Name: "VCALENDAR", Comps: []caldav.CompFilter{{Name: "VTODO"}}},
+	})
+	if err != nil {
+		t.Fatalf("query %s: %v", position, err)
+	}
+	return objects
+}
+
+func TestCalDAVDiscovery(t *testing.T) {
+	client, _, _ := newDAVTest(t)
+	ctx := context.Background()
+
+	principal, err := client.FindCurrentUserPrincipal(ctx)
+	if err != nil || principal != "/dav/" {
+		t.Fatalf("principal = %q, %v", principal, err)
+	}
+	home, err := client.FindCalendarHomeSet(ctx, principal)
+	if err != nil || home != "/dav/calendars/" {
+		t.Fatalf("home set = %q, %v", home, err)
+	}
+	calendars, err := client.FindCalendars(ctx, home)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(calendars) != 6 {
+		t.Fatalf("got %d calendars, want 6", len(calendars))
+	}
+	for _, cal := range calendars {
+		if len(cal.SupportedComponentSet) != 1 || cal.SupportedComponentSet[0] != "VTODO" {
+			t.Errorf("%s supports %v, want VTODO", cal.Path, cal.SupportedComponentSet)
+		}
+	}
+}
+
+func TestCalDAVPutConditions(t *testing.T) {
+	client, hc, _ := newDAVTest(t)
+	ctx := context.Background()
+	href := "/dav/calendars/do/todo-1.ics"
+
+	// create only if absent
+	hc.header.Set("If-None-Match", "*")
+	created, err := client.PutCalendarObject(ctx, href, davTodo("todo-1", "write tests", false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hc.status != http.StatusCreated || created.ETag == "" {
+		t.Fatalf("create: status %d, etag %q", hc.status, created.ETag)
+	}
+	if _, err := client.PutCalendarObject(ctx, href, davTodo("todo-1", "write tests", false)); err == nil || hc.status != http.StatusPreconditionFailed {
+		t.Fatalf("create over an existing object: status %d, %v", hc.status, err)
+	}
+	hc.header.Del("If-None-Match")
+
+	// the etag from the put is the one the collection reports
+	objects := davQuery(t, client, "do")
+	if len(objects) != 1 || objects[0].ETag != created.ETag {
+		t.Fatalf("query after create: %+v, want etag %q", objects, created.ETag)
+	}
+
+	// update only over the version the client has
+	hc.header.Set("If-Match", `"stale"`)
+	if _, err := client.PutCalendarObject(ctx, href, davTodo("todo-1", "write more tests", false)); err == nil || hc.status != http.StatusPreconditionFailed {
+		t.Fatalf("update with a stale etag: status %d, %v", hc.status, err)
+	}
+	hc.header.Set("If-Match", `"`+created.ETag+`"`)
+	updated, err := client.PutCalendarObject(ctx, href, davTodo("todo-1", "write more tests", false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hc.status != http.StatusNoContent || updated.ETag == "" || updated.ETag == created.ETag {
+		t.Fatalf("update: status %d, etag %q after %q", hc.status, updated.ETag, created.ETag)
+	}
+	hc.header.Del("If-Match")
+
+	objects, err = client.MultiGetCalendar(ctx, "/dav/calendars/do/", &caldav.CalendarMultiGet{
+		Paths:       []string{href},
+		CompRequest: caldav.CalendarCompRequest{Name: "VCALENDAR", AllProps: true, AllComps: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 1 || objects[0].ETag != updated.ETag {
+		t.Fatalf("multiget after update: %+v, want etag %q", objects, updated.ETag)
+	}
+	if summary, _ := objects[0].Data.Children[0].Props.Text(ical.PropSummary); summary != "write more tests" {
+		t.Errorf("summary = %q", summary)
+	}
+}
+
+func TestCalDAVCompleteAndReopen(t *testing.T) {
+	client, _, db := newDAVTest(t)
+	ctx := context.Background()
+
+	if _, err := client.PutCalendarObject(ctx, "/dav/calendars/decide/todo-2.ics", davTodo("todo-2", "plan", false)); err != nil {
+		t.Fatal(err)
+	}
+
+	// completing archives the task but leaves the object where the client wrote it
+	if _, err := client.PutCalendarObject(ctx, "/dav/calendars/decide/todo-2.ics", davTodo("todo-2", "plan", true)); err != nil {
+		t.Fatal(err)
+	}
+	objects := davQuery(t, client, "decide")
+	if len(objects) != 1 {
+		t.Fatalf("decide holds %d tasks after completing, want 1", len(objects))
+	}
+	if status, _ := objects[0].Data.Children[0].Props.Text(ical.PropStatus); status != "COMPLETED" {
+		t.Fatalf("status = %q after completing", status)
+	}
+	if n := len(davQuery(t, client, "archive")); n != 0 {
+		t.Fatalf("archive holds %d tasks, want them under decide", n)
+	}
+	var position string
+	db.QueryRow("SELECT position FROM tasks").Scan(&position)
+	if position != "archive" {
+		t.Fatalf("position = %q after completing, want archive", position)
+	}
+
+	// reopening in place returns it to decide
+	if _, err := client.PutCalendarObject(ctx, "/dav/calendars/decide/todo-2.ics", davTodo("todo-2", "plan", false)); err != nil {
+		t.Fatal(err)
+	}
+	db.QueryRow("SELECT position FROM tasks").Scan(&position)
+	if position != "decide" {
+		t.Fatalf("position = %q after reopening, want decide", position)
+	}
+
+	// a task completed in the archive collection lives there, reopening it there falls back to the inbox
+	if _, err := client.PutCalendarObject(ctx, "/dav/calendars/archive/todo-2.ics", davTodo("todo-2", "plan", true)); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(davQuery(t, client, "archive")); n != 1 {
+		t.Fatalf("archive holds %d tasks, want 1", n)
+	}
+	if _, err := client.PutCalendarObject(ctx, "/dav/calendars/archive/todo-2.ics", davTodo("todo-2", "plan", false)); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(davQuery(t, client, "inbox")); n != 1 {
+		t.Fatalf("inbox holds %d tasks after reopening, want 1", n)
+	}
+}
+
+func TestCalDAVMoveConditions(t *testing.T) {
+	client, hc, _ := newDAVTest(t)
+	ctx := context.Background()
+
+	created, err := client.PutCalendarObject(ctx, "/dav/calendars/inbox/todo-4.ics", davTodo("todo-4", "sort", false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.ETag != "1-1" {
+		t.Fatalf("etag = %q, want one derived from task id and version", created.ETag)
+	}
+
+	// the same uid under another collection moves the task, under the same preconditions
+	hc.header.Set("If-None-Match", "*")
+	if _, err := client.PutCalendarObject(ctx, "/dav/calendars/do/todo-4.ics", davTodo("todo-4", "sort", false)); err == nil || hc.status != http.StatusPreconditionFailed {
+		t.Fatalf("move with If-None-Match: status %d, %v", hc.status, err)
+	}
+	hc.header.Del("If-None-Match")
+	hc.header.Set("If-Match", `"1-0"`)
+	if _, err := client.PutCalendarObject(ctx, "/dav/calendars/do/todo-4.ics", davTodo("todo-4", "sort", false)); err == nil || hc.status != http.StatusPreconditionFailed {
+		t.Fatalf("move with a stale etag: status %d, %v", hc.status, err)
+	}
+	hc.header.Set("If-Match", `"`+created.ETag+`"`)
+	if _, err := client.PutCalendarObject(ctx, "/dav/calendars/do/todo-4.ics", davTodo("todo-4", "sort", false)); err != nil {
+		t.Fatal(err)
+	}
+	hc.header.Del("If-Match")
+	if n := len(davQuery(t, client, "do")); n != 1 {
+		t.Fatalf("do holds %d tasks after the move, want 1", n)
+	}
+
+	// a uid can't be taken over by another object
+	if _, err := client.PutCalendarObject(ctx, "/dav/calendars/do/todo-5.ics", davTodo("todo-5", "other", false)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.PutCalendarObject(ctx, "/dav/calendars/do/todo-5.ics", davTodo("todo-4", "other", false)); err == nil || hc.status != http.StatusConflict {
+		t.Fatalf("reusing a uid: status %d, %v", hc.status, err)
+	}
+}
+
+func TestCalDAVDelete(t *testing.T) {
+	client, hc, _ := newDAVTest(t)
+	ctx := context.Background()
+	href := "/dav/calendars/inbox/todo-3.ics"
+
+	created, err := client.PutCalendarObject(ctx, href, davTodo("todo-3", "tidy up", false))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hc.header.Set("If-Match", `"stale"`)
+	if err := client.RemoveAll(ctx, href); err == nil || hc.status != http.StatusPreconditionFailed {
+		t.Fatalf("delete with a stale etag: status %d, %v", hc.status, err)
+	}
+	hc.header.Set("If-Match", `"`+created.ETag+`"`)
+	if err := client.RemoveAll(ctx, href); err != nil {
+		t.Fatal(err)
+	}
+	hc.header.Del("If-Match")
+
+	if n := len(davQuery(t, client, "inbox")); n != 0 {
+		t.Fatalf("inbox holds %d tasks after delete", n)
+	}
+	if err := client.RemoveAll(ctx, href); err == nil || hc.status != http.StatusNotFound {
+		t.Fatalf("deleting again: status %d, %v", hc.status, err)
+	}
+}
+
+func TestCalDAVCredentialCache(t *testing.T) {
+	db := davTestDB(t)
+	cache := auth.NewCredentialCache(time.Minute)
+
+	user, err := cache.Authenticate(db, "alice", "correct horse battery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cache.Authenticate(db, "alice", "wrong horse battery"); err == nil {
+		t.Fatal("a wrong password passed while the right one was cached")
+	}
+	if _, err := cache.Authenticate(db, "alice", "correct horse battery"); err != nil {
+		t.Fatal(err)
+	}
+
+	// disabling and password changes take effect before the entry expires
+	if err := auth.SetDisabled(db, user.ID, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cache.Authenticate(db, "alice", "correct horse battery"); !errors.Is(err, auth.ErrDisabled) {
+		t.Fatalf("disabled account: %v", err)
+	}
+	if err := auth.SetDisabled(db, user.ID, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := auth.SetTemporaryPassword(db, user.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cache.Authenticate(db, "alice", "correct horse battery"); err == nil {
+		t.Fatal("the old password still works after a change")
+	}
+}
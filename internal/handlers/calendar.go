@@ -0,0 +1,144 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"taskbox/internal/auth"
+	"taskbox/internal/calendar"
+	"taskbox/internal/models"
+	"time"
+)
+
+// secret ics feed: /cal/{token}.ics
+func (h *Handler) CalendarFeed(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	token := strings.TrimPrefix(r.URL.Path, "/cal/")
+	if !strings.HasSuffix(token, ".ics") {
+		http.NotFound(w, r)
+		return
+	}
+	token = strings.TrimSuffix(token, ".ics")
+
+	user, err := auth.GetUserFromCalendarToken(h.db, token)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	rows, err := h.db.QueryContext(r.Context(), `
+		SELECT id, title, description, due_date, tags, position, matrix_order, created_at, updated_at
+		FROM tasks
+		WHERE user_id = ? AND due_date IS NOT NULL AND position != 'archive'
+		ORDER BY due_date, id
+	`, user.ID)
+	if err != nil {
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	tasks := []models.Task{}
+	for rows.Next() {
+		var task models.Task
+		var tagsJSON sql.NullString
+		var dueDateStr sql.NullString
+		var description sql.NullString
+
+		err := rows.Scan(
+			&task.ID,
+			&task.Title,
+			&description,
+			&dueDateStr,
+			&tagsJSON,
+			&task.Position,
+			&task.MatrixOrder,
+			&task.CreatedAt,
+			&task.UpdatedAt,
+		)
+		if err != nil {
+			continue
+		}
+
+		task.UserID = user.ID
+		if description.Valid {
+			task.Description = description.String
+		}
+		if dueDateStr.Valid {
+			t, err := time.Parse(time.RFC3339, dueDateStr.String)
+			if err != nil {
+				continue
+			}
+			task.DueDate = &t
+		}
+		if tagsJSON.Valid && tagsJSON.String != "" {
+			json.Unmarshal([]byte(tagsJSON.String), &task.Tags)
+		}
+
+		tasks = append(tasks, task)
+	}
+
+	body := calendar.Render(tasks, baseURL(r))
+	sum := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "private, max-age=300")
+	if match := r.Header.Get("If-None-Match"); match != "" && strings.Contains(match, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	if r.Method == "HEAD" {
+		return
+	}
+	w.Write(body)
+}
+
+// feed url panel: GET /calendar, POST /calendar/token to regenerate
+func (h *Handler) Calendar(w http.ResponseWriter, r *http.Request) {
+	user := h.getCurrentUser(r)
+	if user == nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var token string
+	var err error
+	switch {
+	case r.Method == "GET" && r.URL.Path == "/calendar":
+		token, err = auth.GetCalendarToken(h.db, user.ID)
+	case r.Method == "POST" && r.URL.Path == "/calendar/token":
+		token, err = auth.RegenerateCalendarToken(h.db, user.ID)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		http.Error(w, "failed to load calendar token", http.StatusInternalServerError)
+		return
+	}
+
+	data := map[string]interface{}{
+		"FeedURL": baseURL(r) + "/cal/" + token + ".ics",
+	}
+
+	h.render(w, r, "calendar-feed", data)
+}
+
+// absolute base url of the current request
+func baseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
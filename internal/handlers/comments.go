@@ -4,19 +4,21 @@ import (
 	"net/http"
 	"strings"
 	"taskbox/internal/models"
+	"taskbox/internal/webhooks"
+	"time"
 )
 
 func (h *Handler) GetComments(w http.ResponseWriter, r *http.Request, user *models.User, taskID int) {
 	// verify task belongs to user
 	var userID int
-	err := h.db.QueryRow("SELECT user_id FROM tasks WHERE id = ?", taskID).Scan(&userID)
+	err := h.db.QueryRowContext(r.Context(), "SELECT user_id FROM tasks WHERE id = ?", taskID).Scan(&userID)
 	if err != nil || userID != user.ID {
 		http.Error(w, "task not found", http.StatusNotFound)
 		return
 	}
 
 	// get comments
-	rows, err := h.db.Query(`
+	rows, err := h.db.QueryContext(r.Context(), `
 		SELECT c.id, c.task_id, c.user_id, c.content, c.created_at, u.username
 		FROM comments c
 		JOIN users u ON u.id = c.user_id
@@ -57,13 +59,14 @@ func (h *Handler) GetComments(w http.ResponseWriter, r *http.Request, user *mode
 		"TaskID":   taskID,
 	}
 
-	h.templates.ExecuteTemplate(w, "comments-list", data)
+	h.render(w, r, "comments-list", data)
 }
 
 func (h *Handler) AddComment(w http.ResponseWriter, r *http.Request, user *models.User, taskID int) {
 	// verify task belongs to user
 	var userID int
-	err := h.db.QueryRow("SELECT user_id FROM tasks WHERE id = ?", taskID).Scan(&userID)
+	var position string
+	err := h.db.QueryRowContext(r.Context(), "SELECT user_id, position FROM tasks WHERE id = ?", taskID).Scan(&userID, &position)
 	if err != nil || userID != user.ID {
 		http.Error(w, "task not found", http.StatusNotFound)
 		return
@@ -76,7 +79,7 @@ func (h *Handler) AddComment(w http.ResponseWriter, r *http.Request, user *model
 	}
 
 	// insert comment
-	result, err := h.db.Exec(`
+	result, err := h.db.ExecContext(r.Context(), `
 		INSERT INTO comments (task_id, user_id, content)
 		VALUES (?, ?, ?)
 	`, taskID, user.ID, content)
@@ -87,16 +90,25 @@ func (h *Handler) AddComment(w http.ResponseWriter, r *http.Request, user *model
 
 	commentID, _ := result.LastInsertId()
 
+	h.webhooks.Publish(user.ID, webhooks.CommentCreated, map[string]interface{}{
+		"id":      commentID,
+		"task_id": taskID,
+		"content": content,
+	})
+
 	// return comment html
 	data := map[string]interface{}{
 		"Comment": models.Comment{
-			ID:      int(commentID),
-			TaskID:  taskID,
-			UserID:  user.ID,
-			Content: content,
+			ID:        int(commentID),
+			TaskID:    taskID,
+			UserID:    user.ID,
+			Content:   content,
+			CreatedAt: time.Now(),
 		},
 		"Username": user.Username,
 	}
 
-	h.templates.ExecuteTemplate(w, "comment-item", data)
+	h.broadcastComment(r, user.ID, position, data)
+
+	h.render(w, r, "comment-item", data)
 }
@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"taskbox/internal/scss"
+	"time"
+)
+
+// dev mode stylesheet stream: css after a good scss compile, css-error with the sass output after a failed one
+func (h *Handler) DevReload(w http.ResponseWriter, r *http.Request) {
+	// 204 tells EventSource to stop reconnecting
+	if !scss.Watching() {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	rc := http.NewResponseController(w)
+	extend := func() bool {
+		return rc.SetWriteDeadline(time.Now().Add(h.writeTimeout)) == nil
+	}
+	if !extend() {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	results, cancel := scss.Subscribe()
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	// pages loaded while the scss is broken get the overlay straight away
+	if _, err := scss.LastCompile(); err != nil {
+		writeCSSEvent(w, err)
+	}
+	if rc.Flush() != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(25 * time.Second)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			extend()
+			fmt.Fprint(w, ": ping\n\n")
+		case err, ok := <-results:
+			// watcher stopped for shutdown
+			if !ok {
+				return
+			}
+			extend()
+			writeCSSEvent(w, err)
+		}
+		if rc.Flush() != nil {
+			return
+		}
+	}
+}
+
+func writeCSSEvent(w http.ResponseWriter, err error) {
+	if err == nil {
+		fmt.Fprintf(w, "event: css\ndata: %d\n\n", time.Now().UnixMilli())
+		return
+	}
+	fmt.Fprint(w, "event: css-error\n")
+	for _, line := range strings.Split(err.Error(), "\n") {
+		fmt.Fprintf(w, "data: %s\n", line)
+	}
+	fmt.Fprint(w, "\n")
+}
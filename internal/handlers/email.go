@@ -0,0 +1,140 @@
+package handlers
+
+import (
+	"mime"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+	"taskbox/internal/auth"
+	"taskbox/internal/mailin"
+	"taskbox/internal/models"
+)
+
+// email capture panel: GET /email, POST /email/token, POST /email/senders, DELETE /email/senders/{id}
+func (h *Handler) Email(w http.ResponseWriter, r *http.Request) {
+	user := h.getCurrentUser(r)
+	if user == nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if h.inboxDomain == "" {
+		http.Error(w, "email capture is not enabled", http.StatusNotFound)
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/email")
+	switch {
+	case r.Method == "GET" && path == "":
+		h.renderEmail(w, r, user, "")
+	case r.Method == "POST" && path == "/token":
+		if _, err := auth.RegenerateInboxToken(h.db, user.ID); err != nil {
+			http.Error(w, "failed to regenerate address", http.StatusInternalServerError)
+			return
+		}
+		h.renderEmail(w, r, user, "")
+	case r.Method == "POST" && path == "/senders":
+		h.addSender(w, r, user)
+	case r.Method == "DELETE" && strings.HasPrefix(path, "/senders/"):
+		id, err := strconv.Atoi(strings.TrimPrefix(path, "/senders/"))
+		if err != nil {
+			http.Error(w, "invalid sender id", http.StatusBadRequest)
+			return
+		}
+		h.db.ExecContext(r.Context(), "DELETE FROM inbox_senders WHERE id = ? AND user_id = ?", id, user.ID)
+		h.renderEmail(w, r, user, "")
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *Handler) addSender(w http.ResponseWriter, r *http.Request, user *models.User) {
+	address, err := mail.ParseAddress(strings.TrimSpace(r.FormValue("address")))
+	if err != nil {
+		h.renderEmail(w, r, user, "invalid email address")
+		return
+	}
+
+	_, err = h.db.ExecContext(
+		r.Context(),
+		"INSERT OR IGNORE INTO inbox_senders (user_id, address) VALUES (?, ?)",
+		user.ID, strings.ToLower(address.Address),
+	)
+	if err != nil {
+		http.Error(w, "failed to add sender", http.StatusInternalServerError)
+		return
+	}
+
+	h.renderEmail(w, r, user, "")
+}
+
+func (h *Handler) renderEmail(w http.ResponseWriter, r *http.Request, user *models.User, errMsg string) {
+	token, err := auth.GetInboxToken(h.db, user.ID)
+	if err != nil {
+		http.Error(w, "failed to load inbox address", http.StatusInternalServerError)
+		return
+	}
+
+	rows, err := h.db.QueryContext(r.Context(), `
+		SELECT id, user_id, address, created_at
+		FROM inbox_senders
+		WHERE user_id = ?
+		ORDER BY address
+	`, user.ID)
+	if err != nil {
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	senders := []models.InboxSender{}
+	for rows.Next() {
+		var sender models.InboxSender
+		if err := rows.Scan(&sender.ID, &sender.UserID, &sender.Address, &sender.CreatedAt); err != nil {
+			continue
+		}
+		senders = append(senders, sender)
+	}
+
+	data := map[string]interface{}{
+		"Address": mailin.Address(token, h.inboxDomain),
+		"Senders": senders,
+		"Error":   errMsg,
+	}
+
+	h.render(w, r, "email-capture", data)
+}
+
+// download a task attachment: /attachments/{id}
+func (h *Handler) Attachment(w http.ResponseWriter, r *http.Request) {
+	user := h.getCurrentUser(r)
+	if user == nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/attachments/"))
+	if err != nil {
+		http.Error(w, "invalid attachment id", http.StatusBadRequest)
+		return
+	}
+
+	var filename, contentType string
+	var data []byte
+	err = h.db.QueryRowContext(r.Context(), `
+		SELECT a.filename, a.content_type, a.data
+		FROM attachments a
+		JOIN tasks t ON t.id = a.task_id
+		WHERE a.id = ? AND t.user_id = ?
+	`, id, user.ID).Scan(&filename, &contentType, &data)
+	if err != nil {
+		http.Error(w, "attachment not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Write(data)
+}
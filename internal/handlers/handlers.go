@@ -3,62 +3,117 @@ package handlers
 import (
 	"database/sql"
 	"html/template"
-	"log"
+	"io/fs"
+	"log/slog"
 	"net/http"
-	"path/filepath"
+	"os"
+	"strings"
+	"sync"
+	"taskbox"
 	"taskbox/internal/auth"
+	"taskbox/internal/config"
+	"taskbox/internal/events"
+	"taskbox/internal/logging"
+	"taskbox/internal/mailer"
 	"taskbox/internal/models"
+	"taskbox/internal/ratelimit"
+	"taskbox/internal/sso"
+	"taskbox/internal/static"
+	"taskbox/internal/webhooks"
+	"time"
 )
 
 type Handler struct {
-	db        *sql.DB
-	templates *template.Template
-	devMode   bool
+	db          *sql.DB
+	devMode     bool
+	inboxDomain string
+	publicURL   string
+	webhooks    *webhooks.Dispatcher
+	events      *events.Hub
+	mailer      mailer.Mailer
+
+	// swapped by WatchTemplates in dev mode, templatesErr holds the parse error while files are broken
+	templatesMu  sync.RWMutex
+	templates    *template.Template
+	templatesErr error
+
+	// per-event deadline for live streams
+	writeTimeout time.Duration
+
+	// checked by /readyz
+	migrations fs.FS
+	static     fs.FS
+
+	// /static/ with content-hashed urls
+	files *static.Server
+
+	// optional openid connect login, passwordLogin=false leaves it as the only way in
+	sso           *sso.Provider
+	passwordLogin bool
+
+	// open, invite or closed
+	registration string
+
+	// brute force throttles for login and registration
+	loginIPs      *ratelimit.Limiter
+	loginUsers    *ratelimit.Limiter
+	registrations *ratelimit.Limiter
+	resets        *ratelimit.Limiter
+
+	// caldav basic auth sends the password with every request
+	davCredentials *auth.CredentialCache
 }
 
-func New(db *sql.DB, devMode bool) *Handler {
-	log.Println("loading templates...")
-	
-	// parse all templates recursively
-	tmpl := template.New("").Funcs(template.FuncMap{
-		"dict": dict,
-	})
-	
-	// collect all template files
-	patterns := []string{
-		"templates/pages/*.html",
-		"templates/parts/tasks/*.html",
-		"templates/parts/comments/*.html",
+// a non-nil mail enables password resets, a non-nil provider enables single sign-on
+func New(db *sql.DB, cfg *config.Config, assets taskbox.Assets, hooks *webhooks.Dispatcher, hub *events.Hub, mail mailer.Mailer, provider *sso.Provider) *Handler {
+	// email capture addresses are only shown when the listener runs
+	inboxDomain := ""
+	if cfg.SMTPAddr != "" {
+		inboxDomain = cfg.SMTPDomain
 	}
-	
-	allFiles := []string{}
-	for _, pattern := range patterns {
-		matches, err := filepath.Glob(pattern)
-		if err != nil {
-			log.Printf("error globbing %s: %v", pattern, err)
-			continue
-		}
-		log.Printf("found %d templates matching %s", len(matches), pattern)
-		allFiles = append(allFiles, matches...)
+
+	h := &Handler{
+		db:          db,
+		devMode:     cfg.DevMode,
+		inboxDomain: inboxDomain,
+		publicURL:   strings.TrimSuffix(cfg.BaseURL, "/"),
+		webhooks:    hooks,
+		events:      hub,
+		mailer:      mail,
+
+		writeTimeout: cfg.WriteTimeout,
+
+		migrations: assets.Migrations,
+		static:     assets.Static,
+		files:      static.New(assets.Static, cfg.AssetsFromDisk),
+
+		sso:           provider,
+		passwordLogin: provider == nil || !cfg.OIDCDisablePasswordLogin,
+		registration:  cfg.RegistrationMode,
+
+		loginIPs:      ratelimit.New(20, 15*time.Minute, time.Second, 15*time.Minute),
+		loginUsers:    ratelimit.New(5, 15*time.Minute, time.Second, 5*time.Minute),
+		registrations: ratelimit.New(5, time.Hour, time.Minute, time.Hour),
+		resets:        ratelimit.New(5, time.Hour, time.Minute, time.Hour),
+
+		davCredentials: auth.NewCredentialCache(5 * time.Minute),
 	}
-	
-	// parse all files together
-	if len(allFiles) > 0 {
-		var err error
-		tmpl, err = tmpl.ParseFiles(allFiles...)
-		if err != nil {
-			log.Fatalf("error parsing templates: %v", err)
-		}
+
+	// broken templates stop production startup, dev mode shows the error in the browser until fixed
+	tmpl, files, err := h.parseTemplates(assets.Templates)
+	if err != nil && !cfg.DevMode {
+		slog.Error("template parsing failed", "err", err)
+		os.Exit(1)
 	}
-	
-	log.Printf("loaded %d templates", len(allFiles))
-	log.Println("available templates:", tmpl.DefinedTemplates())
-
-	return &Handler{
-		db:        db,
-		templates: tmpl,
-		devMode:   devMode,
+	if err != nil {
+		slog.Error("template parsing failed, showing the error until fixed", "err", err)
+	} else {
+		slog.Info("loaded templates", "files", files)
+		slog.Debug("available templates", "templates", tmpl.DefinedTemplates())
 	}
+	h.templates, h.templatesErr = tmpl, err
+
+	return h
 }
 
 // helper to create a map for template data
@@ -89,6 +144,8 @@ func (h *Handler) getCurrentUser(r *http.Request) *models.User {
 		return nil
 	}
 
+	auth.TouchSession(h.db, token, auth.ClientIP(r), r.UserAgent())
+	logging.SetUser(r.Context(), user.ID)
 	return user
 }
 
@@ -108,3 +165,13 @@ func (h *Handler) requireAuth(next http.HandlerFunc) http.HandlerFunc {
 func (h *Handler) DevMode() bool {
 	return h.devMode
 }
+
+// static files under /static/, with immutable caching for hashed urls
+func (h *Handler) Static() http.Handler {
+	return http.StripPrefix("/static/", h.files)
+}
+
+// content-hashed url of a static file for the asset template func: {{asset "css/main.css"}}
+func (h *Handler) assetURL(name string) string {
+	return "/static/" + h.files.Path(name)
+}
@@ -0,0 +1,121 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"taskbox/internal/database"
+	"taskbox/internal/scss"
+	"time"
+)
+
+// check results; warn is reported but doesn't make the server unready
+const (
+	checkOK   = "ok"
+	checkWarn = "warn"
+	checkFail = "fail"
+)
+
+type healthReport struct {
+	Status string        `json:"status"`
+	Checks []healthCheck `json:"checks,omitempty"`
+}
+
+type healthCheck struct {
+	Name      string  `json:"name"`
+	Status    string  `json:"status"`
+	LatencyMS float64 `json:"latency_ms"`
+	Detail    string  `json:"detail,omitempty"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// liveness: the process is up and serving, dependencies aren't touched
+func (h *Handler) Healthz(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, http.StatusOK, healthReport{Status: "ok"})
+}
+
+// readiness: database reachable, schema current, templates loaded and css built, else 503 with the failures
+func (h *Handler) Readyz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+
+	checks := []healthCheck{
+		runCheck("database", func() (string, string, error) {
+			return checkOK, "", h.db.PingContext(ctx)
+		}),
+		runCheck("migrations", func() (string, string, error) {
+			applied, latest, err := database.Versions(h.db, h.migrations)
+			if err != nil {
+				return checkFail, "", err
+			}
+			detail := fmt.Sprintf("version %d of %d", applied, latest)
+			if applied != latest {
+				return checkFail, detail, errors.New("schema is not at the latest migration")
+			}
+			return checkOK, detail, nil
+		}),
+		runCheck("templates", func() (string, string, error) {
+			tmpl, err := h.templateSet()
+			if err != nil {
+				return checkFail, "", err
+			}
+			for _, name := range []string{"index.html", "login.html"} {
+				if tmpl.Lookup(name) == nil {
+					return checkFail, "", fmt.Errorf("template %s not loaded", name)
+				}
+			}
+			return checkOK, fmt.Sprintf("%d templates", len(tmpl.Templates())), nil
+		}),
+		runCheck("scss", func() (string, string, error) {
+			if _, err := fs.Stat(h.static, "css/main.css"); err != nil {
+				return checkFail, "", fmt.Errorf("stylesheet missing: %w", err)
+			}
+			at, err := scss.LastCompile()
+			if at.IsZero() {
+				return checkOK, "not compiled since startup", nil
+			}
+			detail := "last compiled " + at.UTC().Format(time.RFC3339)
+			if err != nil {
+				// the previous stylesheet is still served
+				return checkWarn, detail, err
+			}
+			return checkOK, detail, nil
+		}),
+	}
+
+	status, code := "ready", http.StatusOK
+	for _, c := range checks {
+		if c.Status == checkFail {
+			status, code = "not ready", http.StatusServiceUnavailable
+		}
+	}
+	writeHealth(w, code, healthReport{Status: status, Checks: checks})
+}
+
+func runCheck(name string, check func() (string, string, error)) healthCheck {
+	start := time.Now()
+	status, detail, err := check()
+	c := healthCheck{
+		Name:      name,
+		Status:    status,
+		LatencyMS: float64(time.Since(start).Microseconds()) / 1000,
+		Detail:    detail,
+	}
+	if err != nil {
+		if c.Status == checkOK {
+			c.Status = checkFail
+		}
+		c.Error = err.Error()
+	}
+	return c
+}
+
+func writeHealth(w http.ResponseWriter, code int, report healthReport) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(report)
+}
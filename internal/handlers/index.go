@@ -3,36 +3,33 @@ package handlers
 import (
 	"database/sql"
 	"encoding/json"
-	"log"
+	"log/slog"
 	"net/http"
+	"taskbox/internal/auth"
+	"taskbox/internal/csrf"
 	"taskbox/internal/models"
 	"time"
 )
 
 func (h *Handler) Index(w http.ResponseWriter, r *http.Request) {
-	log.Println("index handler called")
-	
 	user := h.getCurrentUser(r)
 	if user == nil {
-		log.Println("no user, redirecting to login")
 		http.Redirect(w, r, "/login", http.StatusSeeOther)
 		return
 	}
 
-	log.Printf("user authenticated: %s", user.Username)
-
 	// fetch all tasks for user
-	rows, err := h.db.Query(`
+	rows, err := h.db.QueryContext(r.Context(), `
 		SELECT 
 			t.id, t.title, t.description, t.due_date, t.tags, t.position, 
-			t.matrix_order, t.created_at, t.updated_at,
+			t.matrix_order, t.version, t.created_at, t.updated_at,
 			(SELECT COUNT(*) FROM comments c WHERE c.task_id = t.id) as comment_count
 		FROM tasks t
 		WHERE t.user_id = ?
 		ORDER BY t.position, t.matrix_order
 	`, user.ID)
 	if err != nil {
-		log.Printf("database error: %v", err)
+		slog.ErrorContext(r.Context(), "loading tasks failed", "err", err)
 		http.Error(w, "database error", http.StatusInternalServerError)
 		return
 	}
@@ -64,6 +61,7 @@ func (h *Handler) Index(w http.ResponseWriter, r *http.Request) {
 			&tagsJSON,
 			&task.Position,
 			&task.MatrixOrder,
+			&task.Version,
 			&task.CreatedAt,
 			&task.UpdatedAt,
 			&commentCount,
@@ -93,19 +91,20 @@ func (h *Handler) Index(w http.ResponseWriter, r *http.Request) {
 		taskCount++
 	}
 
-	log.Printf("loaded %d tasks", taskCount)
+	slog.DebugContext(r.Context(), "loaded tasks", "count", taskCount)
+
+	// per-tab id for live updates
+	clientID, _ := auth.GenerateToken()
 
 	data := map[string]interface{}{
 		"User":            user,
+		"ClientID":        clientID,
 		"TasksByPosition": tasksByPosition,
 		"DevMode":         h.devMode,
+		"EmailCapture":    h.inboxDomain != "",
+		"Invites":         h.registration == auth.RegistrationInvite,
+		"CSRFToken":       csrf.Token(r),
 	}
 
-	log.Println("executing template: index.html")
-	err = h.templates.ExecuteTemplate(w, "index.html", data)
-	if err != nil {
-		log.Printf("template execution error: %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-	}
-	log.Println("template executed successfully")
+	h.render(w, r, "index.html", data)
 }
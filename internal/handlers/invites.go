@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"taskbox/internal/auth"
+	"taskbox/internal/csrf"
+	"taskbox/internal/models"
+	"time"
+)
+
+// invite codes for invite-only registration: GET, POST /invites, POST /invites/{id}/revoke
+func (h *Handler) Invites(w http.ResponseWriter, r *http.Request) {
+	user := h.getCurrentUser(r)
+	if user == nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	if h.registration != auth.RegistrationInvite {
+		http.NotFound(w, r)
+		return
+	}
+
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/invites"), "/")
+	switch {
+	case r.Method == "GET" && path == "":
+		h.renderInvites(w, r, user, "")
+	case r.Method == "POST" && path == "":
+		uses, err := strconv.Atoi(r.FormValue("uses"))
+		if err != nil || uses < 1 || uses > 100 {
+			h.renderInvites(w, r, user, "uses must be between 1 and 100")
+			return
+		}
+		days, err := strconv.Atoi(r.FormValue("days"))
+		if err != nil || days < 1 || days > 30 {
+			h.renderInvites(w, r, user, "expiry must be between 1 and 30 days")
+			return
+		}
+		if _, err := auth.CreateInvite(h.db, user.ID, uses, time.Duration(days)*24*time.Hour); err != nil {
+			http.Error(w, "failed to create invite", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, "/invites", http.StatusSeeOther)
+	case r.Method == "POST" && strings.HasSuffix(path, "/revoke"):
+		id, err := strconv.Atoi(strings.TrimSuffix(path, "/revoke"))
+		if err != nil {
+			http.Error(w, "invalid invite id", http.StatusBadRequest)
+			return
+		}
+		if err := auth.RevokeInvite(h.db, id, user.ID, user.IsAdmin); err != nil {
+			http.Error(w, "invite not found", http.StatusNotFound)
+			return
+		}
+		http.Redirect(w, r, "/invites", http.StatusSeeOther)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// admins see and manage every invite, members only their own
+func (h *Handler) renderInvites(w http.ResponseWriter, r *http.Request, user *models.User, errMsg string) {
+	invites, err := auth.ListInvites(h.db, user.ID, user.IsAdmin)
+	if err != nil {
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+
+	h.render(w, r, "invites.html", map[string]interface{}{
+		"User":        user,
+		"Invites":     invites,
+		"ShowCreator": user.IsAdmin,
+		"BaseURL":     h.linkBase(),
+		"Error":       errMsg,
+		"DevMode":     h.devMode,
+		"CSRFToken":   csrf.Token(r),
+	})
+}
@@ -0,0 +1,219 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"taskbox/internal/events"
+	"taskbox/internal/models"
+	"time"
+)
+
+// live board events
+const (
+	eventTaskCreated  = "task-created"
+	eventTaskMoved    = "task-moved"
+	eventTaskUpdated  = "task-updated"
+	eventTaskDeleted  = "task-deleted"
+	eventCommentAdded = "comment-added"
+)
+
+const clientHeader = "X-Client-ID"
+
+// server-sent event stream for the current user: /events?client={id}
+func (h *Handler) Events(w http.ResponseWriter, r *http.Request) {
+	user := h.getCurrentUser(r)
+	if user == nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// every event gets its own deadline, the server's write timeout would cut the stream
+	rc := http.NewResponseController(w)
+	extend := func() bool {
+		return rc.SetWriteDeadline(time.Now().Add(h.writeTimeout)) == nil
+	}
+	if !extend() {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	messages, cancel := h.events.Subscribe(user.ID, r.URL.Query().Get("client"))
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if rc.Flush() != nil {
+		return
+	}
+
+	// comments keep proxies from closing idle streams
+	heartbeat := time.NewTicker(25 * time.Second)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			extend()
+			fmt.Fprint(w, ": ping\n\n")
+		case msg, ok := <-messages:
+			// hub closed for shutdown
+			if !ok {
+				return
+			}
+			extend()
+			fmt.Fprintf(w, "event: %s\n", msg.Event)
+			for _, line := range strings.Split(msg.Data, "\n") {
+				fmt.Fprintf(w, "data: %s\n", line)
+			}
+			fmt.Fprint(w, "\n")
+		}
+		if rc.Flush() != nil {
+			return
+		}
+	}
+}
+
+// push fresh task lists for the given positions to the user's other tabs
+func (h *Handler) broadcast(r *http.Request, userID int, event string, positions ...string) {
+	h.publishLists(r.Context(), r.Header.Get(clientHeader), userID, event, positions...)
+}
+
+// live update for a task created outside a request, such as inbound mail
+func (h *Handler) TaskCreated(ctx context.Context, userID int, position string) {
+	h.publishLists(ctx, "", userID, eventTaskCreated, position)
+}
+
+// task lists to every connection but origin's
+func (h *Handler) publishLists(ctx context.Context, origin string, userID int, event string, positions ...string) {
+	if !h.events.Connected(userID) {
+		return
+	}
+
+	lists := []map[string]interface{}{}
+	seen := map[string]bool{}
+	for _, position := range positions {
+		if position == "" || seen[position] {
+			continue
+		}
+		seen[position] = true
+
+		tasks, err := h.positionTasks(ctx, userID, position)
+		if err != nil {
+			slog.ErrorContext(ctx, "live update query failed", "err", err)
+			return
+		}
+		lists = append(lists, map[string]interface{}{
+			"Position": position,
+			"Tasks":    tasks,
+		})
+	}
+
+	h.publishFragment(ctx, origin, userID, event, map[string]interface{}{"Lists": lists})
+}
+
+// append a new comment to open task details and refresh the card's comment count
+func (h *Handler) broadcastComment(r *http.Request, userID int, position string, comment map[string]interface{}) {
+	if !h.events.Connected(userID) {
+		return
+	}
+
+	tasks, err := h.positionTasks(r.Context(), userID, position)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "live update query failed", "err", err)
+		return
+	}
+
+	h.publishFragment(r.Context(), r.Header.Get(clientHeader), userID, eventCommentAdded, map[string]interface{}{
+		"Lists":   []map[string]interface{}{{"Position": position, "Tasks": tasks}},
+		"Comment": comment,
+	})
+}
+
+func (h *Handler) publishFragment(ctx context.Context, origin string, userID int, event string, data map[string]interface{}) {
+	var buf bytes.Buffer
+	tmpl, err := h.templateSet()
+	if err != nil {
+		return
+	}
+	if err := tmpl.ExecuteTemplate(&buf, "live-update", data); err != nil {
+		slog.ErrorContext(ctx, "template execution failed", "template", "live-update", "err", err)
+		return
+	}
+
+	h.events.Publish(userID, origin, events.Message{
+		Event: event,
+		Data:  buf.String(),
+	})
+}
+
+// task card data for one position, in board order
+func (h *Handler) positionTasks(ctx context.Context, userID int, position string) ([]map[string]interface{}, error) {
+	rows, err := h.db.QueryContext(ctx, `
+		SELECT
+			t.id, t.title, t.description, t.due_date, t.tags, t.position,
+			t.matrix_order, t.version, t.created_at, t.updated_at,
+			(SELECT COUNT(*) FROM comments c WHERE c.task_id = t.id) as comment_count
+		FROM tasks t
+		WHERE t.user_id = ? AND t.position = ?
+		ORDER BY t.matrix_order
+	`, userID, position)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tasks := []map[string]interface{}{}
+	for rows.Next() {
+		var task models.Task
+		var tagsJSON sql.NullString
+		var dueDateStr sql.NullString
+		var description sql.NullString
+		var commentCount int
+
+		err := rows.Scan(
+			&task.ID,
+			&task.Title,
+			&description,
+			&dueDateStr,
+			&tagsJSON,
+			&task.Position,
+			&task.MatrixOrder,
+			&task.Version,
+			&task.CreatedAt,
+			&task.UpdatedAt,
+			&commentCount,
+		)
+		if err != nil {
+			continue
+		}
+
+		task.UserID = userID
+		if description.Valid {
+			task.Description = description.String
+		}
+		if dueDateStr.Valid {
+			t, _ := time.Parse(time.RFC3339, dueDateStr.String)
+			task.DueDate = &t
+		}
+		if tagsJSON.Valid && tagsJSON.String != "" {
+			json.Unmarshal([]byte(tagsJSON.String), &task.Tags)
+		}
+
+		tasks = append(tasks, map[string]interface{}{
+			"Task":         task,
+			"CommentCount": commentCount,
+		})
+	}
+
+	return tasks, nil
+}
@@ -0,0 +1,159 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"taskbox/internal/auth"
+	"taskbox/internal/csrf"
+	"taskbox/internal/mailer"
+	"taskbox/internal/ratelimit"
+)
+
+// request a reset link: GET, POST /forgot
+func (h *Handler) Forgot(w http.ResponseWriter, r *http.Request) {
+	if h.mailer == nil || !h.passwordLogin {
+		http.NotFound(w, r)
+		return
+	}
+
+	if r.Method == "GET" {
+		h.renderForgot(w, r, "", "")
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if wait, ok := h.resets.Allow(auth.ClientIP(r)); !ok {
+		ratelimit.SetRetryAfter(w, wait)
+		w.WriteHeader(http.StatusTooManyRequests)
+		h.renderForgot(w, r, "too many reset requests, try again in "+waitText(wait), "")
+		return
+	}
+
+	login := strings.TrimSpace(r.FormValue("login"))
+	if login == "" {
+		h.renderForgot(w, r, "username or email required", "")
+		return
+	}
+
+	// same answer whether or not the account exists
+	notice := "if that account has an email address, a reset link is on its way"
+
+	user, err := auth.FindUserForReset(h.db, login)
+	if errors.Is(err, sql.ErrNoRows) {
+		h.renderForgot(w, r, "", notice)
+		return
+	}
+	if err != nil {
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+
+	token, err := auth.CreateResetToken(h.db, user.ID)
+	if err != nil {
+		http.Error(w, "failed to create reset link", http.StatusInternalServerError)
+		return
+	}
+
+	link := h.linkBase() + "/reset?token=" + url.QueryEscape(token)
+	msg := mailer.Message{
+		To:      user.Email,
+		Subject: "Reset your TaskBox password",
+		Body: fmt.Sprintf(
+			"Hi %s,\n\nsomeone asked to reset the password for your account. "+
+				"Open this link within %s to choose a new one:\n\n%s\n\n"+
+				"If it wasn't you, ignore this email and your password stays the same.\n",
+			user.Username, waitText(auth.ResetTokenTTL), link,
+		),
+	}
+
+	// send in the background so response time doesn't reveal the account
+	go func() {
+		if err := h.mailer.Send(msg); err != nil {
+			slog.ErrorContext(r.Context(), "password reset mail failed", "user_id", user.ID, "err", err)
+		}
+	}()
+
+	h.renderForgot(w, r, "", notice)
+}
+
+// choose a new password from a reset link: GET, POST /reset?token=
+func (h *Handler) Reset(w http.ResponseWriter, r *http.Request) {
+	if h.mailer == nil || !h.passwordLogin {
+		http.NotFound(w, r)
+		return
+	}
+
+	token := r.FormValue("token")
+	switch r.Method {
+	case "GET":
+		if _, err := auth.CheckResetToken(h.db, token); err != nil {
+			h.renderReset(w, r, "", "this reset link is invalid or has expired")
+			return
+		}
+		h.renderReset(w, r, token, "")
+	case "POST":
+		password := r.FormValue("password")
+		if password == "" {
+			h.renderReset(w, r, token, "new password required")
+			return
+		}
+		if password != r.FormValue("confirm_password") {
+			h.renderReset(w, r, token, "passwords do not match")
+			return
+		}
+
+		var username string
+		if userID, err := auth.CheckResetToken(h.db, token); err == nil {
+			h.db.QueryRowContext(r.Context(), "SELECT username FROM users WHERE id = ?", userID).Scan(&username)
+		}
+		if err := auth.CheckPasswordPolicy(password, username); err != nil {
+			h.renderReset(w, r, token, err.Error())
+			return
+		}
+
+		if _, err := auth.ResetPassword(h.db, token, password); err != nil {
+			if errors.Is(err, auth.ErrInvalidResetToken) {
+				h.renderReset(w, r, "", "this reset link is invalid or has expired")
+				return
+			}
+			http.Error(w, "failed to reset password", http.StatusInternalServerError)
+			return
+		}
+
+		h.renderLogin(w, r, "", "password updated, log in with your new password")
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *Handler) renderForgot(w http.ResponseWriter, r *http.Request, errMsg, notice string) {
+	h.render(w, r, "forgot.html", map[string]interface{}{
+		"Error":     errMsg,
+		"Notice":    notice,
+		"DevMode":   h.devMode,
+		"CSRFToken": csrf.Token(r),
+	})
+}
+
+// an empty token hides the form and only shows the error
+func (h *Handler) renderReset(w http.ResponseWriter, r *http.Request, token, errMsg string) {
+	h.render(w, r, "reset.html", map[string]interface{}{
+		"Token":     token,
+		"Error":     errMsg,
+		"DevMode":   h.devMode,
+		"CSRFToken": csrf.Token(r),
+	})
+}
+
+// configured public url, never the request's host headers; empty (links stay relative) only without an smtp relay
+func (h *Handler) linkBase() string {
+	return h.publicURL
+}
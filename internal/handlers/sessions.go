@@ -0,0 +1,55 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"taskbox/internal/auth"
+	"taskbox/internal/csrf"
+)
+
+// your sessions page: GET /sessions, POST /sessions/{id}/revoke, POST /sessions/revoke-others
+func (h *Handler) Sessions(w http.ResponseWriter, r *http.Request) {
+	user := h.getCurrentUser(r)
+	if user == nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	token := auth.GetSessionToken(r)
+
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/sessions"), "/")
+	switch {
+	case r.Method == "GET" && path == "":
+		sessions, err := auth.ListSessions(h.db, user.ID)
+		if err != nil {
+			http.Error(w, "database error", http.StatusInternalServerError)
+			return
+		}
+		h.render(w, r, "sessions.html", map[string]interface{}{
+			"User":         user,
+			"Sessions":     sessions,
+			"CurrentToken": token,
+			"DevMode":      h.devMode,
+			"CSRFToken":    csrf.Token(r),
+		})
+	case r.Method == "POST" && path == "revoke-others":
+		if err := auth.RevokeOtherSessions(h.db, user.ID, token); err != nil {
+			http.Error(w, "failed to revoke sessions", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, "/sessions", http.StatusSeeOther)
+	case r.Method == "POST" && strings.HasSuffix(path, "/revoke"):
+		id, err := strconv.Atoi(strings.TrimSuffix(path, "/revoke"))
+		if err != nil {
+			http.Error(w, "invalid session id", http.StatusBadRequest)
+			return
+		}
+		if err := auth.RevokeSession(h.db, user.ID, id); err != nil {
+			http.Error(w, "failed to revoke session", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, "/sessions", http.StatusSeeOther)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,137 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+	"taskbox/internal/auth"
+	"taskbox/internal/csrf"
+	"taskbox/internal/models"
+)
+
+// account settings: GET /settings{,/2fa}, POST /settings/{password,email,2fa,2fa/enable,2fa/disable,2fa/recovery,identities/{id}/unlink}
+func (h *Handler) Settings(w http.ResponseWriter, r *http.Request) {
+	user := h.getCurrentUser(r)
+	if user == nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/settings"), "/")
+	switch {
+	case r.Method == "GET" && path == "":
+		h.renderSettings(w, r, user, "", "")
+	case r.Method == "POST" && path == "password":
+		h.changePassword(w, r, user)
+	case r.Method == "POST" && path == "email":
+		h.changeEmail(w, r, user)
+	case r.Method == "GET" && path == "2fa":
+		h.twoFactorSetup(w, r, user)
+	case r.Method == "POST" && path == "2fa":
+		h.startTwoFactor(w, r, user)
+	case r.Method == "POST" && path == "2fa/enable":
+		h.enableTwoFactor(w, r, user)
+	case r.Method == "POST" && path == "2fa/disable":
+		h.disableTwoFactor(w, r, user)
+	case r.Method == "POST" && path == "2fa/recovery":
+		h.regenerateRecoveryCodes(w, r, user)
+	case r.Method == "POST" && strings.HasPrefix(path, "identities/") && strings.HasSuffix(path, "/unlink"):
+		id, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(path, "identities/"), "/unlink"))
+		if err != nil {
+			http.Error(w, "invalid identity id", http.StatusBadRequest)
+			return
+		}
+		err = auth.UnlinkIdentity(h.db, user.ID, id, h.passwordLogin)
+		if errors.Is(err, auth.ErrLastLogin) {
+			h.renderSettings(w, r, user, "this is the only way to sign in to your account, it can't be unlinked", "")
+			return
+		}
+		if err != nil {
+			http.Error(w, "failed to unlink account", http.StatusInternalServerError)
+			return
+		}
+		h.renderSettings(w, r, user, "", "account unlinked")
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *Handler) changePassword(w http.ResponseWriter, r *http.Request, user *models.User) {
+	current := r.FormValue("current_password")
+	password := r.FormValue("password")
+
+	if !h.passwordLogin {
+		h.renderSettings(w, r, user, "password login is disabled on this server", "")
+		return
+	}
+	if password == "" {
+		h.renderSettings(w, r, user, "new password required", "")
+		return
+	}
+	if password != r.FormValue("confirm_password") {
+		h.renderSettings(w, r, user, "new passwords do not match", "")
+		return
+	}
+	if err := auth.CheckPasswordPolicy(password, user.Username); err != nil {
+		h.renderSettings(w, r, user, err.Error(), "")
+		return
+	}
+
+	err := auth.ChangePassword(h.db, user, current, password, auth.GetSessionToken(r))
+	if errors.Is(err, auth.ErrWrongPassword) {
+		h.renderSettings(w, r, user, "current password is incorrect", "")
+		return
+	}
+	if err != nil {
+		http.Error(w, "failed to change password", http.StatusInternalServerError)
+		return
+	}
+
+	h.renderSettings(w, r, user, "", "password changed, other sessions were signed out")
+}
+
+func (h *Handler) changeEmail(w http.ResponseWriter, r *http.Request, user *models.User) {
+	email := strings.TrimSpace(r.FormValue("email"))
+	if email != "" {
+		addr, err := mail.ParseAddress(email)
+		if err != nil || addr.Address != email {
+			h.renderSettings(w, r, user, "enter a plain email address like you@example.com", "")
+			return
+		}
+	}
+
+	if err := auth.SetEmail(h.db, user.ID, email); err != nil {
+		h.renderSettings(w, r, user, "that email is already in use", "")
+		return
+	}
+
+	user.Email = strings.ToLower(email)
+	h.renderSettings(w, r, user, "", "email saved")
+}
+
+func (h *Handler) renderSettings(w http.ResponseWriter, r *http.Request, user *models.User, errMsg, notice string) {
+	data := map[string]interface{}{
+		"User":          user,
+		"Error":         errMsg,
+		"Notice":        notice,
+		"PasswordLogin": h.passwordLogin,
+		"HasPassword":   user.PasswordHash != "",
+		"ResetEnabled":  h.mailer != nil && h.passwordLogin,
+		"TwoFactor":     auth.TwoFactorEnabled(h.db, user.ID),
+		"RecoveryLeft":  auth.RecoveryCodesLeft(h.db, user.ID),
+		"DevMode":       h.devMode,
+		"CSRFToken":     csrf.Token(r),
+	}
+	if h.sso != nil {
+		identities, err := auth.ListIdentities(h.db, user.ID)
+		if err != nil {
+			http.Error(w, "database error", http.StatusInternalServerError)
+			return
+		}
+		data["SSOName"] = h.sso.Name
+		data["Identities"] = identities
+	}
+	h.render(w, r, "settings.html", data)
+}
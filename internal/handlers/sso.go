@@ -0,0 +1,209 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"taskbox/internal/auth"
+	"taskbox/internal/sso"
+)
+
+const ssoCookie = "taskbox_oidc"
+
+// flow state carried in a short-lived cookie across the provider redirect
+type ssoState struct {
+	sso.Flow
+	Link   bool   // attach to the signed-in account instead of logging in
+	Invite string // invite code for a first login in invite mode
+}
+
+// openid connect login: GET /auth/oidc/login, POST /auth/oidc/link, GET /auth/oidc/callback
+func (h *Handler) SSO(w http.ResponseWriter, r *http.Request) {
+	if h.sso == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch {
+	case r.URL.Path == "/auth/oidc/login" && r.Method == "GET":
+		h.startSSO(w, r, false, r.URL.Query().Get("invite"))
+	case r.URL.Path == "/auth/oidc/link" && r.Method == "POST":
+		if h.getCurrentUser(r) == nil {
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+		h.startSSO(w, r, true, "")
+	case r.URL.Path == "/auth/oidc/callback" && r.Method == "GET":
+		h.ssoCallback(w, r)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *Handler) startSSO(w http.ResponseWriter, r *http.Request, link bool, invite string) {
+	flow, err := sso.NewFlow()
+	if err != nil {
+		http.Error(w, "failed to start sign-in", http.StatusInternalServerError)
+		return
+	}
+
+	value, _ := json.Marshal(ssoState{Flow: flow, Link: link, Invite: invite})
+	http.SetCookie(w, &http.Cookie{
+		Name:     ssoCookie,
+		Value:    base64.RawURLEncoding.EncodeToString(value),
+		Path:     "/auth/oidc/",
+		MaxAge:   600,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		// lax so the cookie comes back on the provider's top-level redirect
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	http.Redirect(w, r, h.sso.AuthURL(flow), http.StatusFound)
+}
+
+func (h *Handler) ssoCallback(w http.ResponseWriter, r *http.Request) {
+	state, ok := readSSOState(r)
+	http.SetCookie(w, &http.Cookie{Name: ssoCookie, Path: "/auth/oidc/", MaxAge: -1})
+	if !ok || r.URL.Query().Get("state") != state.State {
+		h.renderLogin(w, r, "sign-in expired, please try again", "")
+		return
+	}
+	if msg := r.URL.Query().Get("error"); msg != "" {
+		h.renderLogin(w, r, "sign-in was cancelled or refused: "+msg, "")
+		return
+	}
+
+	identity, err := h.sso.Exchange(r.Context(), state.Flow, r.URL.Query().Get("code"))
+	if err != nil {
+		slog.WarnContext(r.Context(), "oidc callback failed", "err", err)
+		h.renderLogin(w, r, "sign-in failed, please try again", "")
+		return
+	}
+
+	if state.Link {
+		h.linkIdentity(w, r, identity)
+		return
+	}
+
+	// first login provisions an account as registration_mode allows, later ones find it by identity
+	user, err := auth.GetUserByIdentity(h.db, identity.Issuer, identity.Subject)
+	if errors.Is(err, sql.ErrNoRows) {
+		switch {
+		case h.registration == auth.RegistrationClosed:
+			w.WriteHeader(http.StatusForbidden)
+			h.renderLogin(w, r, "no account is linked to your "+h.sso.Name+" login, ask an administrator for one", "")
+			return
+		case h.registration == auth.RegistrationInvite && state.Invite == "":
+			w.WriteHeader(http.StatusForbidden)
+			h.renderLogin(w, r, "signing up needs an invite code, enter it on the register page", "")
+			return
+		}
+		invite := ""
+		if h.registration == auth.RegistrationInvite {
+			invite = state.Invite
+		}
+		user, err = auth.ProvisionUser(h.db, ssoUsername(identity), verifiedEmail(identity), invite)
+		if errors.Is(err, auth.ErrInvalidInvite) {
+			w.WriteHeader(http.StatusForbidden)
+			h.renderLogin(w, r, err.Error(), "")
+			return
+		}
+		if err == nil {
+			err = auth.LinkIdentity(h.db, user.ID, identity.Issuer, identity.Subject, identity.Email)
+		}
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "oidc account lookup failed", "err", err)
+		http.Error(w, "failed to sign in", http.StatusInternalServerError)
+		return
+	}
+	if auth.IsDisabled(h.db, user.ID) {
+		w.WriteHeader(http.StatusForbidden)
+		h.renderLogin(w, r, "this account has been disabled, contact an administrator", "")
+		return
+	}
+
+	// rotate the session; the provider stands in for the password only
+	if old := auth.GetSessionToken(r); old != "" {
+		auth.DeleteSession(h.db, old)
+	}
+
+	// an enabled second factor is still asked for, as after a password
+	if auth.TwoFactorEnabled(h.db, user.ID) {
+		token, err := auth.CreatePendingSession(h.db, user.ID, auth.ClientIP(r), r.UserAgent())
+		if err != nil {
+			http.Error(w, "failed to create session", http.StatusInternalServerError)
+			return
+		}
+		auth.SetSessionCookie(w, token)
+		http.Redirect(w, r, "/login/2fa", http.StatusSeeOther)
+		return
+	}
+	auth.ResetFailedLogins(h.db, user.ID)
+
+	token, err := auth.CreateSession(h.db, user.ID, auth.ClientIP(r), r.UserAgent())
+	if err != nil {
+		http.Error(w, "failed to create session", http.StatusInternalServerError)
+		return
+	}
+
+	auth.SetSessionCookie(w, token)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+func (h *Handler) linkIdentity(w http.ResponseWriter, r *http.Request, identity *sso.Identity) {
+	user := h.getCurrentUser(r)
+	if user == nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	err := auth.LinkIdentity(h.db, user.ID, identity.Issuer, identity.Subject, identity.Email)
+	if errors.Is(err, auth.ErrIdentityTaken) {
+		h.renderSettings(w, r, user, "that "+h.sso.Name+" account is already linked to another user", "")
+		return
+	}
+	if err != nil {
+		http.Error(w, "failed to link account", http.StatusInternalServerError)
+		return
+	}
+
+	h.renderSettings(w, r, user, "", h.sso.Name+" account linked")
+}
+
+func readSSOState(r *http.Request) (ssoState, bool) {
+	var state ssoState
+	cookie, err := r.Cookie(ssoCookie)
+	if err != nil {
+		return state, false
+	}
+	value, err := base64.RawURLEncoding.DecodeString(cookie.Value)
+	if err != nil || json.Unmarshal(value, &state) != nil || state.State == "" {
+		return state, false
+	}
+	return state, true
+}
+
+// preferred_username, else the email's local part
+func ssoUsername(identity *sso.Identity) string {
+	if identity.PreferredUsername != "" {
+		return identity.PreferredUsername
+	}
+	if local, _, ok := strings.Cut(identity.Email, "@"); ok && local != "" {
+		return local
+	}
+	return "user"
+}
+
+// only provider-verified addresses are trusted for password resets
+func verifiedEmail(identity *sso.Identity) string {
+	if identity.EmailVerified {
+		return identity.Email
+	}
+	return ""
+}
@@ -0,0 +1,364 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"taskbox"
+	"taskbox/internal/auth"
+	"taskbox/internal/config"
+	"taskbox/internal/events"
+	"taskbox/internal/sso"
+	"taskbox/internal/totp"
+	"taskbox/internal/webhooks"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+)
+
+// openid provider that signs in one subject and insists on pkce
+type mockProvider struct {
+	*httptest.Server
+	subject string
+
+	mu     sync.Mutex
+	grants map[string]mockGrant
+}
+
+type mockGrant struct {
+	nonce, challenge string
+}
+
+func newMockProvider(t *testing.T, subject string) *mockProvider {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: jose.JSONWebKey{Key: key, KeyID: "test"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &mockProvider{subject: subject, grants: map[string]mockGrant{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{
+			"issuer":                                p.URL,
+			"authorization_endpoint":                p.URL + "/auth",
+			"token_endpoint":                        p.URL + "/token",
+			"jwks_uri":                              p.URL + "/jwks",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+			{Key: &key.PublicKey, KeyID: "test", Algorithm: "RS256", Use: "sig"},
+		}})
+	})
+	// signs the user in at once and sends the browser back with a code
+	mux.HandleFunc("/auth", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+			http.Error(w, "pkce required", http.StatusBadRequest)
+			return
+		}
+		code := rand.Text()
+		p.mu.Lock()
+		p.grants[code] = mockGrant{nonce: q.Get("nonce"), challenge: q.Get("code_challenge")}
+		p.mu.Unlock()
+
+		callback, _ := url.Parse(q.Get("redirect_uri"))
+		callback.RawQuery = url.Values{"code": {code}, "state": {q.Get("state")}}.Encode()
+		http.Redirect(w, r, callback.String(), http.StatusFound)
+	})
+	// codes are single use and only redeemed with the verifier behind their challenge
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		p.mu.Lock()
+		grant, ok := p.grants[r.Form.Get("code")]
+		delete(p.grants, r.Form.Get("code"))
+		p.mu.Unlock()
+
+		sum := sha256.Sum256([]byte(r.Form.Get("code_verifier")))
+		if !ok || base64.RawURLEncoding.EncodeToString(sum[:]) != grant.challenge {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, `{"error":"invalid_grant"}`)
+			return
+		}
+
+		idToken, err := jwt.Signed(signer).Claims(map[string]any{
+			"iss":                p.URL,
+			"sub":                p.subject,
+			"aud":                "taskbox",
+			"exp":                time.Now().Add(time.Hour).Unix(),
+			"iat":                time.Now().Unix(),
+			"nonce":              grant.nonce,
+			"email":              p.subject + "@corp.example",
+			"email_verified":     true,
+			"preferred_username": p.subject,
+		}).Serialize()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+			"id_token":     idToken,
+		})
+	})
+
+	p.Server = httptest.NewServer(mux)
+	t.Cleanup(p.Close)
+	return p
+}
+
+type ssoTest struct {
+	app      *httptest.Server
+	provider *mockProvider
+	db       *sql.DB
+}
+
+// taskbox signing in through a mock provider, alice already has a password account
+func newSSOTest(t *testing.T) *ssoTest {
+	t.Helper()
+
+	db := davTestDB(t)
+	provider := newMockProvider(t, "carol")
+
+	mux := http.NewServeMux()
+	app := httptest.NewServer(mux)
+	t.Cleanup(app.Close)
+
+	p, err := sso.New(context.Background(), sso.Config{
+		Issuer:      provider.URL,
+		ClientID:    "taskbox",
+		RedirectURL: app.URL + "/auth/oidc/callback",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := config.Default()
+	h := New(db, &cfg, taskbox.EmbeddedAssets(), webhooks.NewDispatcher(db), events.NewHub(), nil, p)
+	mux.HandleFunc("/auth/oidc/", h.SSO)
+	mux.HandleFunc("/login/2fa", h.LoginTwoFactor)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {})
+
+	return &ssoTest{app: app, provider: provider, db: db}
+}
+
+// a browser with its own cookies, optionally signed in as userID
+func (s *ssoTest) browser(t *testing.T, userID int) *http.Client {
+	t.Helper()
+	jar, _ := cookiejar.New(nil)
+	if userID != 0 {
+		token, err := auth.CreateSession(s.db, userID, "127.0.0.1", "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		app, _ := url.Parse(s.app.URL)
+		jar.SetCookies(app, []*http.Cookie{{Name: "taskbox_session", Value: token, Path: "/"}})
+	}
+	return &http.Client{Jar: jar}
+}
+
+// the user behind the browser's session cookie, nil when it has no full session
+func (s *ssoTest) sessionUser(client *http.Client) *int {
+	app, _ := url.Parse(s.app.URL)
+	for _, cookie := range client.Jar.Cookies(app) {
+		if cookie.Name != "taskbox_session" {
+			continue
+		}
+		if user, err := auth.GetUserFromSession(s.db, cookie.Value); err == nil {
+			return &user.ID
+		}
+	}
+	return nil
+}
+
+func body(t *testing.T, resp *http.Response) string {
+	t.Helper()
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestSSOLogin(t *testing.T) {
+	s := newSSOTest(t)
+	client := s.browser(t, 0)
+
+	resp, err := client.Get(s.app.URL + "/auth/oidc/login")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.Request.URL.Path != "/" {
+		t.Fatalf("ended at %s, want /", resp.Request.URL)
+	}
+
+	// open registration provisions carol and links her identity
+	userID := s.sessionUser(client)
+	if userID == nil {
+		t.Fatal("no session after signing in")
+	}
+	user, err := auth.GetUserByIdentity(s.db, s.provider.URL, "carol")
+	if err != nil || user.ID != *userID || user.Username != "carol" {
+		t.Fatalf("identity belongs to %+v, %v; session is user %d", user, err, *userID)
+	}
+}
+
+func TestSSOStolenCode(t *testing.T) {
+	s := newSSOTest(t)
+	noFollow := func(req *http.Request, via []*http.Request) error { return http.ErrUseLastResponse }
+
+	// the victim's code, issued for the victim's pkce challenge
+	victim := s.browser(t, 0)
+	victim.CheckRedirect = noFollow
+	resp, err := victim.Get(s.app.URL + "/auth/oidc/login")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = victim.Get(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	callback, _ := url.Parse(resp.Header.Get("Location"))
+	code := callback.Query().Get("code")
+
+	// the attacker starts their own flow and swaps in the victim's code
+	attacker := s.browser(t, 0)
+	attacker.CheckRedirect = noFollow
+	resp, err = attacker.Get(s.app.URL + "/auth/oidc/login")
+	if err != nil {
+		t.Fatal(err)
+	}
+	authURL, _ := url.Parse(resp.Header.Get("Location"))
+	state := authURL.Query().Get("state")
+
+	resp, err = attacker.Get(s.app.URL + "/auth/oidc/callback?" + url.Values{"code": {code}, "state": {state}}.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page := body(t, resp); !strings.Contains(page, "sign-in failed") {
+		t.Fatalf("redeeming another flow's code didn't fail:\n%s", page)
+	}
+	if s.sessionUser(attacker) != nil {
+		t.Fatal("the attacker got a session")
+	}
+}
+
+func TestSSOStateMismatch(t *testing.T) {
+	s := newSSOTest(t)
+	client := s.browser(t, 0)
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error { return http.ErrUseLastResponse }
+
+	resp, err := client.Get(s.app.URL + "/auth/oidc/login")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = client.Get(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	callback, _ := url.Parse(resp.Header.Get("Location"))
+	q := callback.Query()
+	q.Set("state", "forged")
+	callback.RawQuery = q.Encode()
+
+	resp, err = client.Get(callback.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page := body(t, resp); !strings.Contains(page, "sign-in expired") {
+		t.Fatalf("forged state accepted:\n%s", page)
+	}
+	if s.sessionUser(client) != nil {
+		t.Fatal("got a session with a forged state")
+	}
+	if _, err := auth.GetUserByIdentity(s.db, s.provider.URL, "carol"); err == nil {
+		t.Fatal("forged state provisioned an account")
+	}
+}
+
+func TestSSOLinkAccount(t *testing.T) {
+	s := newSSOTest(t)
+	var aliceID int
+	s.db.QueryRow("SELECT id FROM users WHERE username = 'alice'").Scan(&aliceID)
+
+	resp, err := s.browser(t, aliceID).PostForm(s.app.URL+"/auth/oidc/link", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page := body(t, resp); !strings.Contains(page, "account linked") {
+		t.Fatalf("linking page:\n%s", page)
+	}
+
+	// the provider login now signs in as alice instead of provisioning carol
+	client := s.browser(t, 0)
+	resp, err = client.Get(s.app.URL + "/auth/oidc/login")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if userID := s.sessionUser(client); userID == nil || *userID != aliceID {
+		t.Fatalf("signed in as %v, want alice (%d)", userID, aliceID)
+	}
+	var users int
+	s.db.QueryRow("SELECT COUNT(*) FROM users").Scan(&users)
+	if users != 1 {
+		t.Fatalf("%d users after linking, want 1", users)
+	}
+}
+
+func TestSSOTwoFactor(t *testing.T) {
+	s := newSSOTest(t)
+	var aliceID int
+	s.db.QueryRow("SELECT id FROM users WHERE username = 'alice'").Scan(&aliceID)
+	if err := auth.LinkIdentity(s.db, aliceID, s.provider.URL, "carol", ""); err != nil {
+		t.Fatal(err)
+	}
+	secret, err := auth.BeginTOTPEnrollment(s.db, aliceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, _ := totp.Code(secret, totp.Step(time.Now()))
+	if _, err := auth.EnableTOTP(s.db, aliceID, code); err != nil {
+		t.Fatal(err)
+	}
+
+	// the provider vouches for the password, the code is still asked for
+	client := s.browser(t, 0)
+	resp, err := client.Get(s.app.URL + "/auth/oidc/login")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.Request.URL.Path != "/login/2fa" {
+		t.Fatalf("ended at %s, want /login/2fa", resp.Request.URL)
+	}
+	if s.sessionUser(client) != nil {
+		t.Fatal("full session before the second factor")
+	}
+}
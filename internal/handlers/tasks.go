@@ -1,9 +1,10 @@
 package handlers
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
-	"log"
+	"log/slog"
 	"net/http"
 	"strconv"
 	"strings"
@@ -56,10 +57,10 @@ func (h *Handler) TaskDetail(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *Handler) getTasks(w http.ResponseWriter, r *http.Request, user *models.User) {
-	rows, err := h.db.Query(`
+	rows, err := h.db.QueryContext(r.Context(), `
 		SELECT 
 			t.id, t.title, t.description, t.due_date, t.tags, t.position, 
-			t.matrix_order, t.created_at, t.updated_at,
+			t.matrix_order, t.version, t.created_at, t.updated_at,
 			(SELECT COUNT(*) FROM comments c WHERE c.task_id = t.id) as comment_count
 		FROM tasks t
 		WHERE t.user_id = ?
@@ -96,6 +97,7 @@ func (h *Handler) getTasks(w http.ResponseWriter, r *http.Request, user *models.
 			&tagsJSON,
 			&task.Position,
 			&task.MatrixOrder,
+			&task.Version,
 			&task.CreatedAt,
 			&task.UpdatedAt,
 			&commentCount,
@@ -128,7 +130,7 @@ func (h *Handler) getTasks(w http.ResponseWriter, r *http.Request, user *models.
 		"TasksByPosition": tasksByPosition,
 	}
 
-	h.templates.ExecuteTemplate(w, "tasks.html", data)
+	h.render(w, r, "tasks.html", data)
 }
 
 func (h *Handler) createTask(w http.ResponseWriter, r *http.Request, user *models.User) {
@@ -146,13 +148,13 @@ func (h *Handler) createTask(w http.ResponseWriter, r *http.Request, user *model
 
 	// get max matrix_order for this position
 	var maxOrder int
-	h.db.QueryRow(`
+	h.db.QueryRowContext(r.Context(), `
 		SELECT COALESCE(MAX(matrix_order), -1) 
 		FROM tasks 
 		WHERE user_id = ? AND position = ?
 	`, user.ID, position).Scan(&maxOrder)
 
-	result, err := h.db.Exec(`
+	result, err := h.db.ExecContext(r.Context(), `
 		INSERT INTO tasks (user_id, title, position, matrix_order, updated_at)
 		VALUES (?, ?, ?, ?, CURRENT_TIMESTAMP)
 	`, user.ID, title, position, maxOrder+1)
@@ -164,6 +166,9 @@ func (h *Handler) createTask(w http.ResponseWriter, r *http.Request, user *model
 
 	taskID, _ := result.LastInsertId()
 
+	h.webhooks.TaskCreated(user.ID, taskID, title, position)
+	h.broadcast(r, user.ID, eventTaskCreated, position)
+
 	// return task card html fragment
 	task := models.Task{
 		ID:          int(taskID),
@@ -171,6 +176,7 @@ func (h *Handler) createTask(w http.ResponseWriter, r *http.Request, user *model
 		Title:       title,
 		Position:    position,
 		MatrixOrder: maxOrder + 1,
+		Version:     1,
 	}
 
 	data := map[string]interface{}{
@@ -178,22 +184,38 @@ func (h *Handler) createTask(w http.ResponseWriter, r *http.Request, user *model
 		"CommentCount": 0,
 	}
 
-	h.templates.ExecuteTemplate(w, "task-card", data)
+	h.render(w, r, "task-card", data)
 }
 
 func (h *Handler) getTask(w http.ResponseWriter, r *http.Request, user *models.User, id int) {
-	log.Printf("getTask called for task id %d by user %d", id, user.ID)
-	
+	task, err := h.loadTask(r.Context(), user.ID, id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "task not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "loading task failed", "task_id", id, "err", err)
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("ETag", taskETag(task.Version))
+
+	h.render(w, r, "task-detail", task)
+}
+
+// load one task with its attachment metadata
+func (h *Handler) loadTask(ctx context.Context, userID, id int) (*models.Task, error) {
 	var task models.Task
 	var tagsJSON sql.NullString
 	var dueDateStr sql.NullString
 	var description sql.NullString
 
-	err := h.db.QueryRow(`
-		SELECT id, title, description, due_date, tags, position, matrix_order, created_at, updated_at
+	err := h.db.QueryRowContext(ctx, `
+		SELECT id, title, description, due_date, tags, position, matrix_order, version, created_at, updated_at
 		FROM tasks
 		WHERE id = ? AND user_id = ?
-	`, id, user.ID).Scan(
+	`, id, userID).Scan(
 		&task.ID,
 		&task.Title,
 		&description,
@@ -201,22 +223,15 @@ func (h *Handler) getTask(w http.ResponseWriter, r *http.Request, user *models.U
 		&tagsJSON,
 		&task.Position,
 		&task.MatrixOrder,
+		&task.Version,
 		&task.CreatedAt,
 		&task.UpdatedAt,
 	)
-
-	if err == sql.ErrNoRows {
-		log.Printf("task %d not found", id)
-		http.Error(w, "task not found", http.StatusNotFound)
-		return
-	}
 	if err != nil {
-		log.Printf("database error fetching task %d: %v", id, err)
-		http.Error(w, "database error", http.StatusInternalServerError)
-		return
+		return nil, err
 	}
 
-	task.UserID = user.ID
+	task.UserID = userID
 	if description.Valid {
 		task.Description = description.String
 	}
@@ -228,20 +243,31 @@ func (h *Handler) getTask(w http.ResponseWriter, r *http.Request, user *models.U
 		json.Unmarshal([]byte(tagsJSON.String), &task.Tags)
 	}
 
-	log.Printf("executing template task-detail for task %d: %s", task.ID, task.Title)
-	err = h.templates.ExecuteTemplate(w, "task-detail", task)
-	if err != nil {
-		log.Printf("template execution error: %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	// attachment metadata, file bodies are served by /attachments/{id}
+	attachments, err := h.db.QueryContext(ctx, `
+		SELECT id, task_id, filename, content_type, size, created_at
+		FROM attachments
+		WHERE task_id = ?
+		ORDER BY id
+	`, task.ID)
+	if err == nil {
+		for attachments.Next() {
+			var a models.Attachment
+			if err := attachments.Scan(&a.ID, &a.TaskID, &a.Filename, &a.ContentType, &a.Size, &a.CreatedAt); err == nil {
+				task.Attachments = append(task.Attachments, a)
+			}
+		}
+		attachments.Close()
 	}
-	log.Println("template executed successfully")
+
+	return &task, nil
 }
 
 func (h *Handler) updateTask(w http.ResponseWriter, r *http.Request, user *models.User, id int) {
 	// verify task belongs to user
 	var userID int
-	err := h.db.QueryRow("SELECT user_id FROM tasks WHERE id = ?", id).Scan(&userID)
+	var oldPosition string
+	err := h.db.QueryRowContext(r.Context(), "SELECT user_id, position FROM tasks WHERE id = ?", id).Scan(&userID, &oldPosition)
 	if err == sql.ErrNoRows || userID != user.ID {
 		http.Error(w, "task not found", http.StatusNotFound)
 		return
@@ -250,20 +276,24 @@ func (h *Handler) updateTask(w http.ResponseWriter, r *http.Request, user *model
 	// build update query dynamically based on provided fields
 	updates := []string{}
 	args := []interface{}{}
+	changed := []string{}
 
 	if title := r.FormValue("title"); title != "" {
 		updates = append(updates, "title = ?")
+		changed = append(changed, "title")
 		args = append(args, title)
 	}
 
 	if r.Form.Has("description") {
 		description := r.FormValue("description")
 		updates = append(updates, "description = ?")
+		changed = append(changed, "description")
 		args = append(args, description)
 	}
 
 	if dueDate := r.FormValue("due_date"); dueDate != "" {
 		updates = append(updates, "due_date = ?")
+		changed = append(changed, "due_date")
 		args = append(args, dueDate)
 	}
 
@@ -275,12 +305,17 @@ func (h *Handler) updateTask(w http.ResponseWriter, r *http.Request, user *model
 		}
 		tagsJSON, _ := json.Marshal(tagList)
 		updates = append(updates, "tags = ?")
+		changed = append(changed, "tags")
 		args = append(args, string(tagsJSON))
 	}
 
 	if position := r.FormValue("position"); position != "" {
 		updates = append(updates, "position = ?")
 		args = append(args, position)
+		if position == "archive" && oldPosition != "archive" {
+			updates = append(updates, "previous_position = ?")
+			args = append(args, oldPosition)
+		}
 	}
 
 	if order := r.FormValue("matrix_order"); order != "" {
@@ -293,22 +328,105 @@ func (h *Handler) updateTask(w http.ResponseWriter, r *http.Request, user *model
 		return
 	}
 
-	updates = append(updates, "updated_at = CURRENT_TIMESTAMP")
+	updates = append(updates, "version = version + 1", "updated_at = CURRENT_TIMESTAMP")
 	args = append(args, id)
 
+	// callers that present a version only write over that version, and edits to the content must present one
 	query := "UPDATE tasks SET " + strings.Join(updates, ", ") + " WHERE id = ?"
-	_, err = h.db.Exec(query, args...)
+	expected, hasVersion := requestVersion(r)
+	if !hasVersion && len(changed) > 0 {
+		http.Error(w, "edits need the version they were made against", http.StatusPreconditionRequired)
+		return
+	}
+	if hasVersion {
+		query += " AND version = ?"
+		args = append(args, expected)
+	}
+
+	result, err := h.db.ExecContext(r.Context(), query, args...)
 	if err != nil {
 		http.Error(w, "failed to update task", http.StatusInternalServerError)
 		return
 	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		h.taskConflict(w, r, user, id)
+		return
+	}
+
+	var version int
+	h.db.QueryRowContext(r.Context(), "SELECT version FROM tasks WHERE id = ?", id).Scan(&version)
+	w.Header().Set("ETag", taskETag(version))
+
+	position := r.FormValue("position")
+	if position != "" && position != oldPosition {
+		h.broadcast(r, user.ID, eventTaskMoved, oldPosition, position)
+	} else {
+		h.broadcast(r, user.ID, eventTaskUpdated, oldPosition)
+	}
+
+	h.webhooks.TaskChanged(user.ID, id, oldPosition, position, changed)
+
+	// keep the open detail form on the new version
+	if r.Header.Get("HX-Request") == "true" {
+		h.render(w, r, "task-version-oob", map[string]interface{}{
+			"ID":      id,
+			"Version": version,
+		})
+		return
+	}
 
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("ok"))
 }
 
+// reply to a stale update with the conflict prompt over the current server state, background fetches just reload on the status
+func (h *Handler) taskConflict(w http.ResponseWriter, r *http.Request, user *models.User, id int) {
+	task, err := h.loadTask(r.Context(), user.ID, id)
+	if err != nil {
+		http.Error(w, "task not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("ETag", taskETag(task.Version))
+
+	data := map[string]interface{}{
+		"Task": task,
+		"Mine": map[string]interface{}{
+			"Title":       r.FormValue("title"),
+			"Description": r.FormValue("description"),
+			"DueDate":     r.FormValue("due_date"),
+			"Tags":        r.FormValue("tags"),
+		},
+	}
+
+	w.Header().Set("HX-Retarget", "#task-sidebar-content")
+	w.Header().Set("HX-Reswap", "innerHTML")
+	w.WriteHeader(http.StatusConflict)
+	h.render(w, r, "task-conflict", data)
+}
+
+// version presented by the client as a form field or If-Match header
+func requestVersion(r *http.Request) (int, bool) {
+	value := r.FormValue("version")
+	if value == "" {
+		value = strings.Trim(strings.TrimPrefix(r.Header.Get("If-Match"), "W/"), `"`)
+	}
+	version, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, false
+	}
+	return version, true
+}
+
+func taskETag(version int) string {
+	return `"` + strconv.Itoa(version) + `"`
+}
+
 func (h *Handler) deleteTask(w http.ResponseWriter, r *http.Request, user *models.User, id int) {
-	result, err := h.db.Exec("DELETE FROM tasks WHERE id = ? AND user_id = ?", id, user.ID)
+	var position string
+	h.db.QueryRowContext(r.Context(), "SELECT position FROM tasks WHERE id = ? AND user_id = ?", id, user.ID).Scan(&position)
+
+	result, err := h.db.ExecContext(r.Context(), "DELETE FROM tasks WHERE id = ? AND user_id = ?", id, user.ID)
 	if err != nil {
 		http.Error(w, "failed to delete task", http.StatusInternalServerError)
 		return
@@ -320,5 +438,8 @@ func (h *Handler) deleteTask(w http.ResponseWriter, r *http.Request, user *model
 		return
 	}
 
+	h.webhooks.TaskDeleted(user.ID, id)
+	h.broadcast(r, user.ID, eventTaskDeleted, position)
+
 	w.WriteHeader(http.StatusOK)
 }
@@ -0,0 +1,115 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"html/template"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"taskbox/internal/watch"
+)
+
+// template directories, relative to the templates tree
+var templatePatterns = []string{
+	"pages/*.html",
+	"parts/tasks/*.html",
+	"parts/comments/*.html",
+	"parts/calendar/*.html",
+	"parts/email/*.html",
+	"parts/webhooks/*.html",
+	"parts/dev/*.html",
+}
+
+// parse every template in fsys into one set
+func (h *Handler) parseTemplates(fsys fs.FS) (*template.Template, int, error) {
+	tmpl := template.New("").Funcs(template.FuncMap{
+		"dict":  dict,
+		"join":  strings.Join,
+		"asset": h.assetURL,
+	})
+
+	allFiles := []string{}
+	for _, pattern := range templatePatterns {
+		matches, err := fs.Glob(fsys, pattern)
+		if err != nil {
+			return nil, 0, fmt.Errorf("template pattern %s: %w", pattern, err)
+		}
+		slog.Debug("found templates", "pattern", pattern, "count", len(matches))
+		allFiles = append(allFiles, matches...)
+	}
+	if len(allFiles) == 0 {
+		return nil, 0, errors.New("no templates found")
+	}
+
+	tmpl, err := tmpl.ParseFS(fsys, allFiles...)
+	if err != nil {
+		return nil, 0, err
+	}
+	return tmpl, len(allFiles), nil
+}
+
+// current template set, or the parse error that replaced it
+func (h *Handler) templateSet() (*template.Template, error) {
+	h.templatesMu.RLock()
+	defer h.templatesMu.RUnlock()
+	return h.templates, h.templatesErr
+}
+
+func (h *Handler) setTemplates(tmpl *template.Template, err error) {
+	h.templatesMu.Lock()
+	defer h.templatesMu.Unlock()
+	if err == nil {
+		h.templates = tmpl
+	}
+	h.templatesErr = err
+}
+
+// execute a template and log failures with the request, showing the parse error while templates are broken
+func (h *Handler) render(w http.ResponseWriter, r *http.Request, name string, data interface{}) {
+	tmpl, err := h.templateSet()
+	if err != nil {
+		renderTemplateError(w, err)
+		return
+	}
+	if err := tmpl.ExecuteTemplate(w, name, data); err != nil {
+		slog.ErrorContext(r.Context(), "template execution failed", "template", name, "err", err)
+	}
+}
+
+func renderTemplateError(w http.ResponseWriter, err error) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusInternalServerError)
+	fmt.Fprintf(w, `<!DOCTYPE html>
+<html>
+<head><title>template error</title></head>
+<body style="font-family: monospace; padding: 2em;">
+<h1>template error</h1>
+<pre style="white-space: pre-wrap; color: #b00020;">%s</pre>
+<p>fix the template and reload, it is re-parsed on save.</p>
+</body>
+</html>
+`, html.EscapeString(err.Error()))
+}
+
+// re-parse templates whenever an html file under dir changes, until ctx is done
+func (h *Handler) WatchTemplates(ctx context.Context, dir string) {
+	fsys := os.DirFS(dir)
+	err := watch.Tree(ctx, dir, ".html", func() {
+		tmpl, files, err := h.parseTemplates(fsys)
+		h.setTemplates(tmpl, err)
+		if err != nil {
+			slog.Error("template reload failed", "err", err)
+			return
+		}
+		slog.Info("reloaded templates", "files", files)
+	})
+	if err != nil {
+		slog.Error("template watcher failed", "err", err)
+		<-ctx.Done()
+	}
+}
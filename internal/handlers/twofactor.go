@@ -0,0 +1,193 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"errors"
+	"html/template"
+	"net/http"
+	"taskbox/internal/auth"
+	"taskbox/internal/csrf"
+	"taskbox/internal/models"
+	"taskbox/internal/totp"
+
+	"github.com/skip2/go-qrcode"
+)
+
+// second step of login for accounts with 2fa: GET, POST /login/2fa
+func (h *Handler) LoginTwoFactor(w http.ResponseWriter, r *http.Request) {
+	token := auth.GetSessionToken(r)
+	user, err := auth.GetPendingUser(h.db, token)
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	if r.Method == "GET" {
+		h.renderLoginTwoFactor(w, r, "")
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ip := auth.ClientIP(r)
+	if wait := max(h.loginIPs.Wait(ip), h.loginUsers.Wait(user.Username)); wait > 0 {
+		w.WriteHeader(http.StatusTooManyRequests)
+		h.renderLoginTwoFactor(w, r, "too many attempts, try again in "+waitText(wait))
+		return
+	}
+
+	// a lockout ends the pending login before any code is checked
+	if wait := auth.LockedFor(h.db, user.Username); wait > 0 {
+		auth.DeleteSession(h.db, token)
+		auth.ClearSessionCookie(w)
+		h.loginThrottled(w, r, wait, "account locked after too many failed attempts, try again in "+waitText(wait))
+		return
+	}
+
+	err = auth.VerifySecondFactor(h.db, user.ID, r.FormValue("code"))
+	if errors.Is(err, auth.ErrInvalidCode) {
+		h.loginIPs.Hit(ip)
+		h.loginUsers.Hit(user.Username)
+		auth.RecordFailedLogin(h.db, user.Username, ip, r.UserAgent(), auth.ReasonBadCode)
+
+		// a lockout ends the pending login as well
+		if wait := auth.LockedFor(h.db, user.Username); wait > 0 {
+			auth.DeleteSession(h.db, token)
+			auth.ClearSessionCookie(w)
+			h.loginThrottled(w, r, wait, "account locked after too many failed attempts, try again in "+waitText(wait))
+			return
+		}
+		h.renderLoginTwoFactor(w, r, "invalid code")
+		return
+	}
+	if err != nil {
+		http.Error(w, "failed to verify code", http.StatusInternalServerError)
+		return
+	}
+
+	h.loginUsers.Reset(user.Username)
+	auth.ResetFailedLogins(h.db, user.ID)
+
+	// swap the pending session for a full one
+	auth.DeleteSession(h.db, token)
+	full, err := auth.CreateSession(h.db, user.ID, ip, r.UserAgent())
+	if err != nil {
+		http.Error(w, "failed to create session", http.StatusInternalServerError)
+		return
+	}
+
+	auth.SetSessionCookie(w, full)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+func (h *Handler) renderLoginTwoFactor(w http.ResponseWriter, r *http.Request, errMsg string) {
+	h.render(w, r, "login-2fa.html", map[string]interface{}{
+		"Error":     errMsg,
+		"DevMode":   h.devMode,
+		"CSRFToken": csrf.Token(r),
+	})
+}
+
+// enrollment page: GET /settings/2fa, shows the pending secret so a reload keeps the scanned code valid
+func (h *Handler) twoFactorSetup(w http.ResponseWriter, r *http.Request, user *models.User) {
+	secret := auth.PendingTOTPSecret(h.db, user.ID)
+	if secret == "" || auth.TwoFactorEnabled(h.db, user.ID) {
+		http.Redirect(w, r, "/settings", http.StatusSeeOther)
+		return
+	}
+	h.renderTwoFactorSetup(w, r, user, secret, "")
+}
+
+// start enrollment with a fresh secret: POST /settings/2fa
+func (h *Handler) startTwoFactor(w http.ResponseWriter, r *http.Request, user *models.User) {
+	if auth.TwoFactorEnabled(h.db, user.ID) {
+		http.Redirect(w, r, "/settings", http.StatusSeeOther)
+		return
+	}
+
+	if _, err := auth.BeginTOTPEnrollment(h.db, user.ID); err != nil {
+		http.Error(w, "failed to start enrollment", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/settings/2fa", http.StatusSeeOther)
+}
+
+// confirm enrollment: POST /settings/2fa/enable
+func (h *Handler) enableTwoFactor(w http.ResponseWriter, r *http.Request, user *models.User) {
+	codes, err := auth.EnableTOTP(h.db, user.ID, r.FormValue("code"))
+	if errors.Is(err, auth.ErrInvalidCode) {
+		secret := auth.PendingTOTPSecret(h.db, user.ID)
+		if secret == "" {
+			http.Redirect(w, r, "/settings", http.StatusSeeOther)
+			return
+		}
+		h.renderTwoFactorSetup(w, r, user, secret, "that code didn't match, check your device clock and try again")
+		return
+	}
+	if err != nil {
+		http.Error(w, "failed to enable two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+
+	h.renderRecoveryCodes(w, r, codes)
+}
+
+// turn 2fa off: POST /settings/2fa/disable
+func (h *Handler) disableTwoFactor(w http.ResponseWriter, r *http.Request, user *models.User) {
+	if !auth.CheckPassword(r.FormValue("current_password"), user.PasswordHash) {
+		h.renderSettings(w, r, user, "current password is incorrect", "")
+		return
+	}
+	if err := auth.DisableTOTP(h.db, user.ID); err != nil {
+		http.Error(w, "failed to disable two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+	h.renderSettings(w, r, user, "", "two-factor authentication disabled")
+}
+
+// fresh recovery codes: POST /settings/2fa/recovery
+func (h *Handler) regenerateRecoveryCodes(w http.ResponseWriter, r *http.Request, user *models.User) {
+	if !auth.TwoFactorEnabled(h.db, user.ID) {
+		http.Redirect(w, r, "/settings", http.StatusSeeOther)
+		return
+	}
+	if !auth.CheckPassword(r.FormValue("current_password"), user.PasswordHash) {
+		h.renderSettings(w, r, user, "current password is incorrect", "")
+		return
+	}
+
+	codes, err := auth.RegenerateRecoveryCodes(h.db, user.ID)
+	if err != nil {
+		http.Error(w, "failed to create recovery codes", http.StatusInternalServerError)
+		return
+	}
+	h.renderRecoveryCodes(w, r, codes)
+}
+
+func (h *Handler) renderTwoFactorSetup(w http.ResponseWriter, r *http.Request, user *models.User, secret, errMsg string) {
+	png, err := qrcode.Encode(totp.URI(secret, "TaskBox", user.Username), qrcode.Medium, 256)
+	if err != nil {
+		http.Error(w, "failed to render qr code", http.StatusInternalServerError)
+		return
+	}
+
+	h.render(w, r, "two-factor.html", map[string]interface{}{
+		"User":      user,
+		"Secret":    secret,
+		"QRCode":    template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(png)),
+		"Error":     errMsg,
+		"DevMode":   h.devMode,
+		"CSRFToken": csrf.Token(r),
+	})
+}
+
+// recovery codes are shown once, right after they are made
+func (h *Handler) renderRecoveryCodes(w http.ResponseWriter, r *http.Request, codes []string) {
+	h.render(w, r, "two-factor.html", map[string]interface{}{
+		"RecoveryCodes": codes,
+		"DevMode":       h.devMode,
+		"CSRFToken":     csrf.Token(r),
+	})
+}
@@ -0,0 +1,192 @@
+package handlers
+
+import (
+	"database/sql"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"taskbox/internal/auth"
+	"taskbox/internal/models"
+	"taskbox/internal/webhooks"
+)
+
+// webhook settings: /webhooks, /webhooks/{id}, /webhooks/{id}/deliveries, /webhooks/deliveries/{id}/redeliver
+func (h *Handler) Webhooks(w http.ResponseWriter, r *http.Request) {
+	user := h.getCurrentUser(r)
+	if user == nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/webhooks"), "/"), "/")
+	switch {
+	case parts[0] == "" && r.Method == "GET":
+		h.renderWebhooks(w, r, user, "")
+	case parts[0] == "" && r.Method == "POST":
+		h.createWebhook(w, r, user)
+	case len(parts) == 1 && r.Method == "DELETE":
+		id, err := strconv.Atoi(parts[0])
+		if err != nil {
+			http.Error(w, "invalid webhook id", http.StatusBadRequest)
+			return
+		}
+		h.db.ExecContext(r.Context(), "DELETE FROM webhook_deliveries WHERE webhook_id IN (SELECT id FROM webhooks WHERE id = ? AND user_id = ?)", id, user.ID)
+		h.db.ExecContext(r.Context(), "DELETE FROM webhooks WHERE id = ? AND user_id = ?", id, user.ID)
+		h.renderWebhooks(w, r, user, "")
+	case len(parts) == 2 && parts[1] == "deliveries" && r.Method == "GET":
+		id, err := strconv.Atoi(parts[0])
+		if err != nil {
+			http.Error(w, "invalid webhook id", http.StatusBadRequest)
+			return
+		}
+		h.renderDeliveries(w, r, user, id)
+	case len(parts) == 3 && parts[0] == "deliveries" && parts[2] == "redeliver" && r.Method == "POST":
+		id, err := strconv.Atoi(parts[1])
+		if err != nil {
+			http.Error(w, "invalid delivery id", http.StatusBadRequest)
+			return
+		}
+		var webhookID int
+		err = h.db.QueryRowContext(r.Context(), "SELECT webhook_id FROM webhook_deliveries WHERE id = ?", id).Scan(&webhookID)
+		if err != nil {
+			http.Error(w, "delivery not found", http.StatusNotFound)
+			return
+		}
+		if err := h.webhooks.Redeliver(user.ID, id); err != nil {
+			http.Error(w, "delivery not found", http.StatusNotFound)
+			return
+		}
+		h.renderDeliveries(w, r, user, webhookID)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *Handler) createWebhook(w http.ResponseWriter, r *http.Request, user *models.User) {
+	target, err := url.Parse(strings.TrimSpace(r.FormValue("url")))
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		h.renderWebhooks(w, r, user, "url must be an absolute http or https url")
+		return
+	}
+	if err := webhooks.CheckURL(r.Context(), target); err != nil {
+		h.renderWebhooks(w, r, user, err.Error())
+		return
+	}
+
+	r.ParseForm()
+	events := []string{}
+	for _, event := range r.Form["events"] {
+		if slices.Contains(webhooks.Events, event) {
+			events = append(events, event)
+		}
+	}
+	if len(events) == 0 || len(events) == len(webhooks.Events) {
+		events = []string{"*"}
+	}
+
+	secret, err := auth.GenerateToken()
+	if err != nil {
+		http.Error(w, "failed to create webhook", http.StatusInternalServerError)
+		return
+	}
+
+	_, err = h.db.ExecContext(
+		r.Context(),
+		"INSERT INTO webhooks (user_id, url, secret, events) VALUES (?, ?, ?, ?)",
+		user.ID, target.String(), secret, strings.Join(events, ","),
+	)
+	if err != nil {
+		http.Error(w, "failed to create webhook", http.StatusInternalServerError)
+		return
+	}
+
+	h.renderWebhooks(w, r, user, "")
+}
+
+func (h *Handler) renderWebhooks(w http.ResponseWriter, r *http.Request, user *models.User, errMsg string) {
+	rows, err := h.db.QueryContext(r.Context(), `
+		SELECT id, user_id, url, secret, events, created_at
+		FROM webhooks
+		WHERE user_id = ?
+		ORDER BY id
+	`, user.ID)
+	if err != nil {
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	hooks := []models.Webhook{}
+	for rows.Next() {
+		var hook models.Webhook
+		var events string
+		if err := rows.Scan(&hook.ID, &hook.UserID, &hook.URL, &hook.Secret, &events, &hook.CreatedAt); err != nil {
+			continue
+		}
+		hook.Events = strings.Split(events, ",")
+		hooks = append(hooks, hook)
+	}
+
+	data := map[string]interface{}{
+		"Webhooks": hooks,
+		"Events":   webhooks.Events,
+		"Error":    errMsg,
+	}
+
+	h.render(w, r, "webhooks", data)
+}
+
+func (h *Handler) renderDeliveries(w http.ResponseWriter, r *http.Request, user *models.User, webhookID int) {
+	rows, err := h.db.QueryContext(r.Context(), `
+		SELECT d.id, d.webhook_id, d.event, d.payload, d.status, d.attempts,
+			d.response_code, d.error, d.created_at, d.delivered_at
+		FROM webhook_deliveries d
+		JOIN webhooks w ON w.id = d.webhook_id
+		WHERE d.webhook_id = ? AND w.user_id = ?
+		ORDER BY d.id DESC
+		LIMIT 50
+	`, webhookID, user.ID)
+	if err != nil {
+		http.Error(w, "database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	deliveries := []models.WebhookDelivery{}
+	for rows.Next() {
+		var d models.WebhookDelivery
+		var code sql.NullInt64
+		var errText sql.NullString
+		var deliveredAt sql.NullTime
+		err := rows.Scan(
+			&d.ID,
+			&d.WebhookID,
+			&d.Event,
+			&d.Payload,
+			&d.Status,
+			&d.Attempts,
+			&code,
+			&errText,
+			&d.CreatedAt,
+			&deliveredAt,
+		)
+		if err != nil {
+			continue
+		}
+		d.ResponseCode = int(code.Int64)
+		d.Error = errText.String
+		if deliveredAt.Valid {
+			d.DeliveredAt = &deliveredAt.Time
+		}
+		deliveries = append(deliveries, d)
+	}
+
+	data := map[string]interface{}{
+		"WebhookID":  webhookID,
+		"Deliveries": deliveries,
+	}
+
+	h.render(w, r, "webhook-deliveries", data)
+}
@@ -0,0 +1,143 @@
+package mailin
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"strings"
+)
+
+// parsed inbound email
+type Message struct {
+	From        string
+	Subject     string
+	Text        string
+	Attachments []Attachment
+}
+
+type Attachment struct {
+	Filename    string
+	ContentType string
+	Data        []byte
+}
+
+var wordDecoder = mime.WordDecoder{}
+
+// parse a raw rfc 5322 message
+func Parse(r io.Reader) (*Message, error) {
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Message{}
+	if subject, err := wordDecoder.DecodeHeader(msg.Header.Get("Subject")); err == nil {
+		m.Subject = strings.TrimSpace(subject)
+	}
+	if from, err := mail.ParseAddress(msg.Header.Get("From")); err == nil {
+		m.From = from.Address
+	}
+
+	err = m.readPart(
+		msg.Header.Get("Content-Type"),
+		msg.Header.Get("Content-Disposition"),
+		msg.Header.Get("Content-Transfer-Encoding"),
+		msg.Body,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	m.Text = strings.TrimSpace(strings.ReplaceAll(m.Text, "\r\n", "\n"))
+	return m, nil
+}
+
+// walk one mime part, recursing into multiparts
+func (m *Message) readPart(contentType, disposition, encoding string, body io.Reader) error {
+	if contentType == "" {
+		contentType = "text/plain"
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = "application/octet-stream"
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		reader := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := reader.NextRawPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			err = m.readPart(
+				part.Header.Get("Content-Type"),
+				part.Header.Get("Content-Disposition"),
+				part.Header.Get("Content-Transfer-Encoding"),
+				part,
+			)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	data, err := io.ReadAll(decodeTransfer(encoding, body))
+	if err != nil {
+		return err
+	}
+
+	dispType, dispParams, _ := mime.ParseMediaType(disposition)
+	filename := dispParams["filename"]
+	if filename == "" {
+		filename = params["name"]
+	}
+	if decoded, err := wordDecoder.DecodeHeader(filename); err == nil {
+		filename = decoded
+	}
+
+	// first inline plain text part is the body, html alternatives are dropped
+	if dispType != "attachment" && filename == "" {
+		if mediaType == "text/plain" && m.Text == "" {
+			m.Text = string(data)
+		}
+		if strings.HasPrefix(mediaType, "text/") {
+			return nil
+		}
+	}
+
+	if filename == "" {
+		filename = "attachment"
+	}
+	m.Attachments = append(m.Attachments, Attachment{
+		Filename:    filename,
+		ContentType: mediaType,
+		Data:        data,
+	})
+	return nil
+}
+
+func decodeTransfer(encoding string, r io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		// tolerate line breaks inside the encoded body
+		raw, _ := io.ReadAll(r)
+		raw = bytes.Map(func(c rune) rune {
+			if c == '\r' || c == '\n' || c == ' ' || c == '\t' {
+				return -1
+			}
+			return c
+		}, raw)
+		return base64.NewDecoder(base64.StdEncoding, bytes.NewReader(raw))
+	case "quoted-printable":
+		return quotedprintable.NewReader(r)
+	default:
+		return r
+	}
+}
@@ -0,0 +1,456 @@
+package mailin
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"taskbox/internal/metrics"
+	"taskbox/internal/webhooks"
+	"time"
+
+	"github.com/emersion/go-msgauth/dkim"
+)
+
+const (
+	maxRecipients  = 10
+	commandTimeout = 5 * time.Minute
+	// rfc 5321 allows 1000 bytes, the rest is room for sloppy clients
+	maxLineBytes = 4096
+)
+
+var errLineTooLong = errors.New("line too long")
+
+// live board updates for tasks created from mail
+type Notifier interface {
+	TaskCreated(ctx context.Context, userID int, position string)
+}
+
+// minimal smtp listener that turns mail into inbox tasks
+type Server struct {
+	db       *sql.DB
+	webhooks *webhooks.Dispatcher
+	live     Notifier
+	domain   string
+	maxBytes int64
+
+	// dkim key lookups, net.LookupTXT when nil
+	lookupTXT func(domain string) ([]string, error)
+
+	mu       sync.Mutex
+	listener net.Listener
+	closed   bool
+	conns    map[net.Conn]struct{}
+	active   sync.WaitGroup
+}
+
+func NewServer(db *sql.DB, hooks *webhooks.Dispatcher, live Notifier, domain string, maxBytes int64) *Server {
+	return &Server{
+		db:       db,
+		webhooks: hooks,
+		live:     live,
+		domain:   domain,
+		maxBytes: maxBytes,
+		conns:    make(map[net.Conn]struct{}),
+	}
+}
+
+// listen on addr and serve connections until Close is called
+func (s *Server) ListenAndServe(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		listener.Close()
+		return net.ErrClosed
+	}
+	s.listener = listener
+	s.mu.Unlock()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return nil
+		}
+		s.conns[conn] = struct{}{}
+		s.active.Add(1)
+		s.mu.Unlock()
+		go func() {
+			defer s.active.Done()
+			s.serve(conn)
+			s.mu.Lock()
+			delete(s.conns, conn)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+// stop accepting connections
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Close()
+}
+
+// stop accepting connections and wait for open sessions, cutting them off once ctx is done
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.Close()
+
+	done := make(chan struct{})
+	go func() {
+		s.active.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		for conn := range s.conns {
+			conn.Close()
+		}
+		s.mu.Unlock()
+		<-done
+		return ctx.Err()
+	}
+}
+
+// one smtp session
+type session struct {
+	from       string
+	recipients []int
+}
+
+// fails reads once a line runs past max bytes, so a client can't make ReadLine buffer without end
+type lineLimiter struct {
+	r    io.Reader
+	max  int
+	line int
+}
+
+func (l *lineLimiter) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	for i, b := range p[:n] {
+		if b == '\n' {
+			l.line = 0
+			continue
+		}
+		if l.line++; l.line > l.max {
+			return i, errLineTooLong
+		}
+	}
+	return n, err
+}
+
+func (s *Server) serve(conn net.Conn) {
+	defer conn.Close()
+
+	text := textproto.NewConn(struct {
+		io.Reader
+		io.WriteCloser
+	}{&lineLimiter{r: conn, max: maxLineBytes}, conn})
+	reply := func(format string, args ...interface{}) {
+		text.PrintfLine(format, args...)
+	}
+
+	reply("220 %s ESMTP Gridwork", s.domain)
+
+	sess := &session{}
+	for {
+		conn.SetDeadline(time.Now().Add(commandTimeout))
+		line, err := text.ReadLine()
+		if errors.Is(err, errLineTooLong) {
+			reply("500 line too long")
+			return
+		}
+		if err != nil {
+			return
+		}
+
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "HELO":
+			sess = &session{}
+			reply("250 %s", s.domain)
+		case "EHLO":
+			sess = &session{}
+			reply("250-%s", s.domain)
+			reply("250-SIZE %d", s.maxBytes)
+			reply("250 8BITMIME")
+		case "MAIL":
+			from, params, ok := parsePath(arg, "FROM:")
+			if !ok {
+				reply("501 syntax: MAIL FROM:<address>")
+				continue
+			}
+			if size, err := strconv.ParseInt(params["SIZE"], 10, 64); err == nil && size > s.maxBytes {
+				reply("552 message exceeds %d bytes", s.maxBytes)
+				continue
+			}
+			sess.from = from
+			sess.recipients = nil
+			reply("250 ok")
+		case "RCPT":
+			if sess.from == "" {
+				reply("503 need MAIL first")
+				continue
+			}
+			to, _, ok := parsePath(arg, "TO:")
+			if !ok {
+				reply("501 syntax: RCPT TO:<address>")
+				continue
+			}
+			if len(sess.recipients) >= maxRecipients {
+				reply("452 too many recipients")
+				continue
+			}
+			userID, err := s.recipient(to)
+			if err != nil {
+				reply("550 %v", err)
+				continue
+			}
+			sess.recipients = append(sess.recipients, userID)
+			reply("250 ok")
+		case "DATA":
+			if len(sess.recipients) == 0 {
+				reply("503 need RCPT first")
+				continue
+			}
+			reply("354 end data with <CR><LF>.<CR><LF>")
+
+			dot := text.DotReader()
+			data, err := io.ReadAll(io.LimitReader(dot, s.maxBytes+1))
+			if errors.Is(err, errLineTooLong) {
+				reply("500 line too long")
+				return
+			}
+			if err != nil {
+				return
+			}
+			if int64(len(data)) > s.maxBytes {
+				// drain the rest of the message before replying
+				io.Copy(io.Discard, dot)
+				reply("552 message exceeds %d bytes", s.maxBytes)
+				sess = &session{}
+				continue
+			}
+
+			from, recipients, err := s.accept(sess, data)
+			if err != nil {
+				slog.Warn("inbound mail refused", "envelope_from", sess.from, "err", err)
+				reply("550 %v", err)
+				sess = &session{}
+				continue
+			}
+
+			err = s.deliver(from, recipients, data)
+			metrics.JobDone("inbound_mail", err)
+			if err != nil {
+				slog.Error("inbound mail failed", "from", from, "err", err)
+				reply("554 %v", err)
+			} else {
+				reply("250 ok")
+			}
+			sess = &session{}
+		case "RSET":
+			sess = &session{}
+			reply("250 ok")
+		case "NOOP":
+			reply("250 ok")
+		case "VRFY":
+			reply("252 cannot verify")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("502 command not implemented")
+		}
+	}
+}
+
+// resolve an inbox address to a user
+func (s *Server) recipient(address string) (int, error) {
+	local, domain, ok := strings.Cut(strings.ToLower(address), "@")
+	if !ok || domain != strings.ToLower(s.domain) || !strings.HasPrefix(local, "in-") {
+		return 0, errors.New("no such mailbox")
+	}
+
+	var userID int
+	err := s.db.QueryRow(
+		"SELECT id FROM users WHERE inbox_token = ?",
+		strings.TrimPrefix(local, "in-"),
+	).Scan(&userID)
+	if err != nil {
+		return 0, errors.New("no such mailbox")
+	}
+	return userID, nil
+}
+
+// the verified sender and the recipients whose allowlist holds it; the envelope sender is anyone's to claim
+func (s *Server) accept(sess *session, data []byte) (string, []int, error) {
+	from, err := s.sender(data)
+	if err != nil {
+		return "", nil, err
+	}
+
+	recipients := []int{}
+	for _, userID := range sess.recipients {
+		var allowed int
+		s.db.QueryRow(
+			"SELECT COUNT(*) FROM inbox_senders WHERE user_id = ? AND address = ?",
+			userID, from,
+		).Scan(&allowed)
+		if allowed > 0 {
+			recipients = append(recipients, userID)
+		}
+	}
+	if len(recipients) == 0 {
+		return "", nil, errors.New("sender not allowed")
+	}
+	return from, recipients, nil
+}
+
+// the header From, vouched for by a valid dkim signature of its domain
+func (s *Server) sender(data []byte) (string, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return "", errors.New("malformed message")
+	}
+	// a second From could show one address while the signature covers the other
+	if len(msg.Header["From"]) != 1 {
+		return "", errors.New("message needs exactly one From header")
+	}
+	from, err := mail.ParseAddress(msg.Header.Get("From"))
+	if err != nil {
+		return "", errors.New("malformed From header")
+	}
+	address := strings.ToLower(from.Address)
+	_, domain, _ := strings.Cut(address, "@")
+
+	verifications, err := dkim.VerifyWithOptions(bytes.NewReader(data), &dkim.VerifyOptions{
+		LookupTXT:        s.lookupTXT,
+		MaxVerifications: 5,
+	})
+	if err != nil && !errors.Is(err, dkim.ErrTooManySignatures) {
+		return "", errors.New("unreadable dkim signature")
+	}
+	for _, v := range verifications {
+		// the signing domain is the sender's or a parent of it
+		signer := strings.ToLower(v.Domain)
+		if v.Err == nil && (domain == signer || strings.HasSuffix(domain, "."+signer)) {
+			return address, nil
+		}
+	}
+	return "", errors.New("sender not verified, needs a dkim signature from its domain")
+}
+
+// create an inbox task with attachments for every recipient
+func (s *Server) deliver(from string, recipients []int, data []byte) error {
+	msg, err := Parse(bytes.NewReader(data))
+	if err != nil {
+		return errors.New("malformed message")
+	}
+
+	title := msg.Subject
+	if title == "" {
+		title = "(no subject)"
+	}
+
+	for _, userID := range recipients {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+
+		var maxOrder int
+		tx.QueryRow(`
+			SELECT COALESCE(MAX(matrix_order), -1)
+			FROM tasks
+			WHERE user_id = ? AND position = 'inbox'
+		`, userID).Scan(&maxOrder)
+
+		result, err := tx.Exec(`
+			INSERT INTO tasks (user_id, title, description, position, matrix_order, updated_at)
+			VALUES (?, ?, ?, 'inbox', ?, CURRENT_TIMESTAMP)
+		`, userID, title, msg.Text, maxOrder+1)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		taskID, _ := result.LastInsertId()
+
+		for _, a := range msg.Attachments {
+			_, err := tx.Exec(`
+				INSERT INTO attachments (task_id, filename, content_type, size, data)
+				VALUES (?, ?, ?, ?, ?)
+			`, taskID, a.Filename, a.ContentType, len(a.Data), a.Data)
+			if err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		slog.Info("inbound mail created task", "from", from, "task_id", taskID)
+		s.webhooks.TaskCreated(userID, taskID, title, "inbox")
+		s.live.TaskCreated(context.Background(), userID, "inbox")
+	}
+
+	return nil
+}
+
+// parse "FROM:<addr> KEY=VALUE ..." into the address and its parameters
+func parsePath(arg, prefix string) (string, map[string]string, bool) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", nil, false
+	}
+	rest := strings.TrimSpace(arg[len(prefix):])
+	if !strings.HasPrefix(rest, "<") {
+		return "", nil, false
+	}
+	end := strings.IndexByte(rest, '>')
+	if end < 0 {
+		return "", nil, false
+	}
+
+	params := map[string]string{}
+	for _, field := range strings.Fields(rest[end+1:]) {
+		key, value, _ := strings.Cut(field, "=")
+		params[strings.ToUpper(key)] = value
+	}
+	return rest[1:end], params, true
+}
+
+// inbox address for a token
+func Address(token, domain string) string {
+	return fmt.Sprintf("in-%s@%s", token, domain)
+}
@@ -0,0 +1,207 @@
+package mailin
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"path/filepath"
+	"strings"
+	"sync"
+	"taskbox"
+	"taskbox/internal/auth"
+	"taskbox/internal/database"
+	"taskbox/internal/webhooks"
+	"testing"
+
+	"github.com/emersion/go-msgauth/dkim"
+)
+
+// remembers the live updates the server sends
+type testNotifier struct {
+	mu      sync.Mutex
+	created []int
+}
+
+func (n *testNotifier) TaskCreated(ctx context.Context, userID int, position string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.created = append(n.created, userID)
+}
+
+type mailTest struct {
+	server *Server
+	db     *sql.DB
+	live   *testNotifier
+	key    ed25519.PrivateKey
+	inbox  string
+}
+
+// a server for inbox.test with alice accepting mail from bob@example.com, whose domain publishes key
+func newMailTest(t *testing.T) *mailTest {
+	t.Helper()
+
+	db, err := database.Open(filepath.Join(t.TempDir(), "taskbox.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := database.RunMigrations(db, taskbox.EmbeddedAssets().Migrations); err != nil {
+		t.Fatal(err)
+	}
+
+	// stored directly, the password is never checked
+	result, err := db.Exec("INSERT INTO users (username, password_hash) VALUES ('alice', '')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	userID, _ := result.LastInsertId()
+	token, err := auth.GetInboxToken(db, int(userID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("INSERT INTO inbox_senders (user_id, address) VALUES (?, 'bob@example.com')", userID); err != nil {
+		t.Fatal(err)
+	}
+
+	public, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	live := &testNotifier{}
+	server := NewServer(db, webhooks.NewDispatcher(db), live, "inbox.test", 1<<20)
+	server.lookupTXT = func(domain string) ([]string, error) {
+		if domain != "test._domainkey.example.com" {
+			return nil, errors.New("no such record")
+		}
+		return []string{"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(public)}, nil
+	}
+
+	return &mailTest{server: server, db: db, live: live, key: key, inbox: Address(token, "inbox.test")}
+}
+
+// a client speaking smtp to the server over an in-memory connection
+func (m *mailTest) dial(t *testing.T) *smtp.Client {
+	t.Helper()
+	serverConn, clientConn := net.Pipe()
+	go m.server.serve(serverConn)
+	client, err := smtp.NewClient(clientConn, "inbox.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// a message from the header address, signed for domain when it isn't empty
+func (m *mailTest) message(t *testing.T, from, subject, domain string) []byte {
+	t.Helper()
+	raw := "From: " + from + "\r\nTo: " + m.inbox + "\r\nSubject: " + subject + "\r\n\r\nsent from my phone\r\n"
+	if domain == "" {
+		return []byte(raw)
+	}
+	var signed bytes.Buffer
+	err := dkim.Sign(&signed, strings.NewReader(raw), &dkim.SignOptions{Domain: domain, Selector: "test", Signer: m.key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed.Bytes()
+}
+
+// send over smtp and return the server's reply code to the message, 250 when accepted
+func (m *mailTest) send(t *testing.T, envelopeFrom string, data []byte) int {
+	t.Helper()
+	client := m.dial(t)
+	if err := client.Mail(envelopeFrom); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Rcpt(m.inbox); err != nil {
+		t.Fatal(err)
+	}
+	w, err := client.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(data)
+	var protoErr *textproto.Error
+	if err := w.Close(); errors.As(err, &protoErr) {
+		return protoErr.Code
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	return 250
+}
+
+func (m *mailTest) titles(t *testing.T) []string {
+	t.Helper()
+	rows, err := m.db.Query("SELECT title FROM tasks WHERE position = 'inbox' ORDER BY id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	titles := []string{}
+	for rows.Next() {
+		var title string
+		rows.Scan(&title)
+		titles = append(titles, title)
+	}
+	return titles
+}
+
+func TestInboundMail(t *testing.T) {
+	m := newMailTest(t)
+
+	if code := m.send(t, "bounces@mailer.example.com", m.message(t, "Bob <bob@example.com>", "buy milk", "example.com")); code != 250 {
+		t.Fatalf("signed mail from an allowed sender: reply %d", code)
+	}
+	if titles := m.titles(t); len(titles) != 1 || titles[0] != "buy milk" {
+		t.Fatalf("inbox holds %q", titles)
+	}
+	if len(m.live.created) != 1 {
+		t.Fatalf("%d live updates, want 1", len(m.live.created))
+	}
+}
+
+func TestInboundMailSpoofedSender(t *testing.T) {
+	m := newMailTest(t)
+
+	// the envelope sender is allowed but nothing vouches for it
+	if code := m.send(t, "bob@example.com", m.message(t, "bob@example.com", "unsigned", "")); code != 550 {
+		t.Errorf("unsigned mail: reply %d, want 550", code)
+	}
+	// signed, but by another domain than the From address
+	if code := m.send(t, "bob@example.com", m.message(t, "bob@example.com", "foreign signature", "evil.test")); code != 550 {
+		t.Errorf("mail signed by another domain: reply %d, want 550", code)
+	}
+	// signed by its own domain, but not on the allowlist
+	if code := m.send(t, "bob@example.com", m.message(t, "mallory@example.com", "not allowed", "example.com")); code != 550 {
+		t.Errorf("mail from an unlisted sender: reply %d, want 550", code)
+	}
+	if titles := m.titles(t); len(titles) != 0 {
+		t.Fatalf("inbox holds %q", titles)
+	}
+}
+
+func TestInboundMailLongLine(t *testing.T) {
+	m := newMailTest(t)
+
+	serverConn, clientConn := net.Pipe()
+	go m.server.serve(serverConn)
+	text := textproto.NewConn(clientConn)
+	defer text.Close()
+	if _, _, err := text.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+
+	// the server gives up on the line instead of buffering it
+	go text.PrintfLine("HELO %s", strings.Repeat("x", 1<<20))
+	if _, _, err := text.ReadResponse(250); err == nil || !strings.Contains(err.Error(), "line too long") {
+		t.Fatalf("overlong command: %v", err)
+	}
+}
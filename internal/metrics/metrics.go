@@ -0,0 +1,223 @@
+package metrics
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "taskbox"
+
+// every taskbox metric plus the go runtime and process collectors
+var Registry = prometheus.NewRegistry()
+
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests by route, method and status.",
+	}, []string{"route", "method", "status"})
+
+	httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latency by route and method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	dbDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "db_query_duration_seconds",
+		Help:      "Database call latency by operation.",
+		Buckets:   []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"op"})
+
+	dbErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "db_errors_total",
+		Help:      "Failed database calls by operation.",
+	}, []string{"op"})
+
+	scssCompiles = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "scss_compiles_total",
+		Help:      "SCSS compilations by result.",
+	}, []string{"result"})
+
+	jobs = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "background_jobs_total",
+		Help:      "Background job runs by job and outcome.",
+	}, []string{"job", "result"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		httpRequests, httpDuration, dbDuration, dbErrors, scssCompiles, jobs,
+	)
+}
+
+// time one database call; op is query, exec, begin, commit or rollback
+func ObserveQuery(op string, start time.Time, err error) {
+	dbDuration.WithLabelValues(op).Observe(time.Since(start).Seconds())
+	if err != nil {
+		dbErrors.WithLabelValues(op).Inc()
+	}
+}
+
+// count a scss compilation
+func SCSSCompiled(err error) {
+	scssCompiles.WithLabelValues(result(err)).Inc()
+}
+
+// count a background job run with an outcome such as ok, error or retry
+func Job(job, outcome string) {
+	jobs.WithLabelValues(job, outcome).Inc()
+}
+
+// count a background job run as ok or error
+func JobDone(job string, err error) {
+	Job(job, result(err))
+}
+
+// ok or error
+func result(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "ok"
+}
+
+// count and time requests by mux pattern, so ids in paths don't blow up the label set
+func Middleware(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		_, route := mux.Handler(r)
+		if route == "" {
+			route = "unmatched"
+		}
+
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sw, r)
+
+		httpRequests.WithLabelValues(route, r.Method, strconv.Itoa(sw.status)).Inc()
+		httpDuration.WithLabelValues(route, r.Method).Observe(time.Since(start).Seconds())
+	})
+}
+
+type statusWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	if !sw.wroteHeader {
+		sw.status = status
+		sw.wroteHeader = true
+	}
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *statusWriter) Write(b []byte) (int, error) {
+	sw.wroteHeader = true
+	return sw.ResponseWriter.Write(b)
+}
+
+func (sw *statusWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+// prometheus text endpoint, scrapers send the token as a bearer token when one is set
+func Handler(token string) http.Handler {
+	metrics := promhttp.HandlerFor(Registry, promhttp.HandlerOpts{
+		ErrorLog: slog.NewLogLogger(slog.Default().Handler(), slog.LevelError),
+	})
+	if token == "" {
+		return metrics
+	}
+
+	want := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="metrics"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		metrics.ServeHTTP(w, r)
+	})
+}
+
+// connection pool stats plus gauges read from the database at scrape time
+func RegisterDB(db *sql.DB) {
+	Registry.MustRegister(
+		collectors.NewDBStatsCollector(db, "taskbox"),
+		&dbCollector{db: db},
+	)
+}
+
+var (
+	openSessionsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "open_sessions"),
+		"Signed-in sessions that have not expired.", nil, nil)
+	tasksDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "tasks"),
+		"Tasks by board position.", []string{"position"}, nil)
+	webhookBacklogDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "webhook_deliveries_pending"),
+		"Webhook deliveries waiting to be sent.", nil, nil)
+)
+
+type dbCollector struct {
+	db *sql.DB
+}
+
+func (c *dbCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- openSessionsDesc
+	ch <- tasksDesc
+	ch <- webhookBacklogDesc
+}
+
+func (c *dbCollector) Collect(ch chan<- prometheus.Metric) {
+	var sessions int
+	err := c.db.QueryRow(`
+		SELECT COUNT(*) FROM sessions
+		WHERE expires_at > CURRENT_TIMESTAMP AND pending_2fa = 0
+	`).Scan(&sessions)
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(openSessionsDesc, err)
+	} else {
+		ch <- prometheus.MustNewConstMetric(openSessionsDesc, prometheus.GaugeValue, float64(sessions))
+	}
+
+	rows, err := c.db.Query("SELECT position, COUNT(*) FROM tasks GROUP BY position")
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(tasksDesc, err)
+	} else {
+		for rows.Next() {
+			var position string
+			var count int
+			if rows.Scan(&position, &count) == nil {
+				ch <- prometheus.MustNewConstMetric(tasksDesc, prometheus.GaugeValue, float64(count), position)
+			}
+		}
+		rows.Close()
+	}
+
+	var pending int
+	err = c.db.QueryRow("SELECT COUNT(*) FROM webhook_deliveries WHERE status = 'pending'").Scan(&pending)
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(webhookBacklogDesc, err)
+	} else {
+		ch <- prometheus.MustNewConstMetric(webhookBacklogDesc, prometheus.GaugeValue, float64(pending))
+	}
+}
@@ -5,17 +5,49 @@ import "time"
 type User struct {
 	ID           int
 	Username     string
+	Email        string
 	PasswordHash string
+	IsAdmin      bool
 	CreatedAt    time.Time
 }
 
+type Identity struct {
+	ID          int
+	UserID      int
+	Issuer      string
+	Subject     string
+	Email       string
+	CreatedAt   time.Time
+	LastLoginAt *time.Time
+}
+
+type Invite struct {
+	ID            int
+	Code          string
+	CreatedBy     int
+	CreatedByName string
+	MaxUses       int
+	Uses          int
+	ExpiresAt     time.Time
+	RevokedAt     *time.Time
+	CreatedAt     time.Time
+	Active        bool
+}
+
 type Session struct {
-	ID        int
-	UserID    int
-	Token     string
-	CreatedAt time.Time
+	ID         int
+	UserID     int
+	Token      string
+	IP         string
+	UserAgent  string
+	LastSeenAt time.Time
+	ExpiresAt  time.Time
+	CreatedAt  time.Time
 }
 
+// board positions in display order
+var Positions = []string{"inbox", "do", "decide", "delegate", "delete", "archive"}
+
 type Task struct {
 	ID          int
 	UserID      int
@@ -25,6 +57,8 @@ type Task struct {
 	Tags        []string
 	Position    string
 	MatrixOrder int
+	Version     int
+	Attachments []Attachment
 	CreatedAt   time.Time
 	UpdatedAt   time.Time
 }
@@ -36,3 +70,41 @@ type Comment struct {
 	Content   string
 	CreatedAt time.Time
 }
+
+type Attachment struct {
+	ID          int
+	TaskID      int
+	Filename    string
+	ContentType string
+	Size        int
+	CreatedAt   time.Time
+}
+
+type InboxSender struct {
+	ID        int
+	UserID    int
+	Address   string
+	CreatedAt time.Time
+}
+
+type Webhook struct {
+	ID        int
+	UserID    int
+	URL       string
+	Secret    string
+	Events    []string
+	CreatedAt time.Time
+}
+
+type WebhookDelivery struct {
+	ID           int
+	WebhookID    int
+	Event        string
+	Payload      string
+	Status       string
+	Attempts     int
+	ResponseCode int
+	Error        string
+	CreatedAt    time.Time
+	DeliveredAt  *time.Time
+}
@@ -0,0 +1,131 @@
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// keyed backoff limiter: Free hits per Window, then each hit doubles the wait from Base up to Max
+type Limiter struct {
+	Free   int
+	Window time.Duration
+	Base   time.Duration
+	Max    time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*entry
+	swept   time.Time
+}
+
+type entry struct {
+	hits    int
+	start   time.Time
+	blocked time.Time
+}
+
+func New(free int, window, base, max time.Duration) *Limiter {
+	return &Limiter{
+		Free:    free,
+		Window:  window,
+		Base:    base,
+		Max:     max,
+		entries: map[string]*entry{},
+	}
+}
+
+// time left before key may try again, zero when allowed
+func (l *Limiter) Wait(key string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	e := l.entries[key]
+	if e == nil || l.expired(e, now) {
+		return 0
+	}
+	if wait := e.blocked.Sub(now); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// record an attempt for key and return the wait it now carries
+func (l *Limiter) Hit(key string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.sweep(now)
+
+	e := l.entries[key]
+	if e == nil || l.expired(e, now) {
+		e = &entry{start: now}
+		l.entries[key] = e
+	}
+	e.hits++
+
+	over := e.hits - l.Free
+	if over <= 0 {
+		return 0
+	}
+
+	wait := l.Max
+	if over <= 20 && l.Base<<(over-1) < l.Max {
+		wait = l.Base << (over - 1)
+	}
+	e.blocked = now.Add(wait)
+	return wait
+}
+
+// record an attempt and report whether it may go ahead
+func (l *Limiter) Allow(key string) (time.Duration, bool) {
+	if wait := l.Wait(key); wait > 0 {
+		return wait, false
+	}
+	wait := l.Hit(key)
+	return wait, wait == 0
+}
+
+// forget key, e.g. after a successful login
+func (l *Limiter) Reset(key string) {
+	l.mu.Lock()
+	delete(l.entries, key)
+	l.mu.Unlock()
+}
+
+// throttle a handler by the key returned for each request
+func (l *Limiter) Middleware(key func(*http.Request) string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if wait, ok := l.Allow(key(r)); !ok {
+			SetRetryAfter(w, wait)
+			http.Error(w, "too many requests", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// whole seconds, rounded up so clients never retry early
+func SetRetryAfter(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", fmt.Sprint(int(math.Ceil(wait.Seconds()))))
+}
+
+// an entry lapses once its window and any block have both passed
+func (l *Limiter) expired(e *entry, now time.Time) bool {
+	return now.Sub(e.start) > l.Window && now.After(e.blocked)
+}
+
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.swept) < l.Window {
+		return
+	}
+	l.swept = now
+	for key, e := range l.entries {
+		if l.expired(e, now) {
+			delete(l.entries, key)
+		}
+	}
+}
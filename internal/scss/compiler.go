@@ -1,99 +1,236 @@
 package scss
 
 import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
 	"io"
-	"log"
+	"io/fs"
+	"log/slog"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"taskbox/internal/metrics"
 	"time"
 )
 
-// compile scss to css using sass binary (managed by go module)
-func Compile(inputPath, outputPath string) error {
-	// try ~/.local/dart-sass/sass first (user installed)
-	sassPath := filepath.Join(os.Getenv("HOME"), ".local/dart-sass/sass")
+// outcome of the last compile, for readiness checks and the dev mode overlay
+var (
+	lastMu      sync.Mutex
+	lastCompile time.Time
+	lastErr     error
+)
 
-	// compile scss
-	cmd := exec.Command(sassPath, "--no-source-map", inputPath, outputPath)
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		log.Printf("sass compilation failed: %v", err)
-		log.Printf("output: %s", string(output))
-		return err
-	}
+// when the last compile ran and its error, zero time before the first
+func LastCompile() (time.Time, error) {
+	lastMu.Lock()
+	defer lastMu.Unlock()
+	return lastCompile, lastErr
+}
 
-	log.Printf("compiled %s -> %s", inputPath, outputPath)
-	return nil
+// oldest dart sass accepted, ruby sass and node-sass take different flags
+const minVersion = "1.33.0"
+
+// where sass ends up when it isn't on PATH, ~ is the home directory
+var knownLocations = []string{
+	"~/.local/dart-sass/sass",
+	"/opt/dart-sass/sass",
+	"./node_modules/.bin/sass",
 }
 
-// watch scss files for changes and recompile
-func Watch(scssDir, cssDir string) {
-	// initial compilation
-	if err := CompileAll(scssDir, cssDir); err != nil {
-		log.Printf("initial scss compilation failed: %v", err)
-	}
+// a resolved sass executable
+type Compiler struct {
+	Sass    string
+	Version string
 
-	// track modification times
-	modTimes := make(map[string]time.Time)
+	// compressed output with source maps, for release builds
+	Release bool
+}
 
-	// watch for changes
-	ticker := time.NewTicker(500 * time.Millisecond)
-	defer ticker.Stop()
+// resolve sass from the configured path, PATH, then the known locations, checking its version
+func Find(configured string) (Compiler, error) {
+	var candidates []string
+	if configured != "" {
+		candidates = []string{configured}
+	} else {
+		candidates = append([]string{"sass"}, knownLocations...)
+	}
 
-	for range ticker.C {
-		changed := false
+	var tried []string
+	for _, candidate := range candidates {
+		if rest, ok := strings.CutPrefix(candidate, "~/"); ok {
+			candidate = filepath.Join(os.Getenv("HOME"), rest)
+		}
+		path, err := exec.LookPath(candidate)
+		if err != nil {
+			tried = append(tried, candidate)
+			continue
+		}
+		// a ruby sass or node-sass earlier on PATH shouldn't hide a dart sass further down
+		version, err := sassVersion(path)
+		if err != nil {
+			tried = append(tried, fmt.Sprintf("%s (%v)", path, err))
+			continue
+		}
+		return Compiler{Sass: path, Version: version}, nil
+	}
+	return Compiler{}, fmt.Errorf("no usable sass (tried %s), install dart sass or set sass_binary", strings.Join(tried, ", "))
+}
 
-		// check all scss files
-		filepath.Walk(scssDir, func(path string, info os.FileInfo, err error) error {
-			if err != nil || info.IsDir() {
-				return nil
-			}
+// run sass --version and check it's a dart sass new enough for our flags
+func sassVersion(path string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
 
-			if filepath.Ext(path) == ".scss" {
-				modTime := info.ModTime()
-				lastModTime, exists := modTimes[path]
+	output, err := exec.CommandContext(ctx, path, "--version").Output()
+	if err != nil {
+		return "", fmt.Errorf("sass --version: %w", err)
+	}
+	// dart sass prints "1.77.8 compiled with dart2js 3.4.4" or just the version
+	fields := strings.Fields(string(output))
+	if len(fields) == 0 || !validVersion(fields[0]) {
+		return "", fmt.Errorf("not dart sass: %q", strings.TrimSpace(string(output)))
+	}
+	if compareVersions(fields[0], minVersion) < 0 {
+		return "", fmt.Errorf("sass %s is older than %s", fields[0], minVersion)
+	}
+	return fields[0], nil
+}
 
-				if !exists || modTime.After(lastModTime) {
-					modTimes[path] = modTime
-					if exists {
-						changed = true
-					}
-				}
-			}
+func validVersion(v string) bool {
+	parts := strings.Split(v, ".")
+	if len(parts) != 3 {
+		return false
+	}
+	for _, p := range parts {
+		if _, err := strconv.Atoi(p); err != nil {
+			return false
+		}
+	}
+	return true
+}
 
-			return nil
-		})
+// numeric comparison of dotted versions
+func compareVersions(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		x, _ := strconv.Atoi(as[i])
+		y, _ := strconv.Atoi(bs[i])
+		if x != y {
+			return cmp.Compare(x, y)
+		}
+	}
+	return cmp.Compare(len(as), len(bs))
+}
 
-		if changed {
-			if err := CompileAll(scssDir, cssDir); err != nil {
-				log.Printf("scss compilation failed: %v", err)
-			}
+// compile one scss file to css
+func (c Compiler) Compile(inputPath, outputPath string) error {
+	args := []string{"--no-source-map"}
+	if c.Release {
+		args = []string{"--style=compressed", "--source-map", "--embed-sources"}
+	}
+	cmd := exec.Command(c.Sass, append(args, inputPath, outputPath)...)
+	output, err := cmd.CombinedOutput()
+	metrics.SCSSCompiled(err)
+	if err != nil {
+		// sass prints the failing rule and line, which the overlay shows
+		if msg := strings.TrimSpace(string(output)); msg != "" {
+			return fmt.Errorf("%s: %s", inputPath, msg)
 		}
+		return fmt.Errorf("%s: %w", inputPath, err)
 	}
+
+	slog.Info("compiled scss", "input", inputPath, "output", outputPath)
+	return nil
+}
+
+// entry points relative to scssDir, every .scss file not starting with an underscore
+func Entries(scssDir string) ([]string, error) {
+	var entries []string
+	err := filepath.WalkDir(scssDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || filepath.Ext(path) != ".scss" || strings.HasPrefix(d.Name(), "_") {
+			return nil
+		}
+		rel, err := filepath.Rel(scssDir, path)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, rel)
+		return nil
+	})
+	return entries, err
+}
+
+// compile entry points to the same path under cssDir, scss/admin/main.scss to css/admin/main.css
+func (c Compiler) CompileAll(scssDir, cssDir string) error {
+	err := c.compileAll(scssDir, cssDir)
+
+	lastMu.Lock()
+	lastCompile, lastErr = time.Now(), err
+	lastMu.Unlock()
+	notify(err)
+
+	return err
 }
 
-// compile all scss files in directory
-func CompileAll(scssDir, cssDir string) error {
-	// ensure output directory exists
-	if err := os.MkdirAll(cssDir, 0755); err != nil {
+func (c Compiler) compileAll(scssDir, cssDir string) error {
+	entries, err := Entries(scssDir)
+	if err != nil {
 		return err
 	}
 
-	// compile main.scss
-	inputPath := filepath.Join(scssDir, "main.scss")
-	outputPath := filepath.Join(cssDir, "main.css")
-
-	if _, err := os.Stat(inputPath); err == nil {
-		if err := Compile(inputPath, outputPath); err != nil {
+	var errs []error
+	for _, entry := range entries {
+		outputPath := filepath.Join(cssDir, strings.TrimSuffix(entry, ".scss")+".css")
+		if err := os.MkdirAll(filepath.Dir(outputPath), 0755); err != nil {
 			return err
 		}
+		if err := c.Compile(filepath.Join(scssDir, entry), outputPath); err != nil {
+			errs = append(errs, err)
+		}
 	}
+	return errors.Join(errs...)
+}
 
+// copy the css and source maps under prebuiltDir into cssDir, for machines without sass
+func CopyPrebuilt(prebuiltDir, cssDir string) error {
+	copied := 0
+	err := filepath.WalkDir(prebuiltDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !(strings.HasSuffix(path, ".css") || strings.HasSuffix(path, ".css.map")) {
+			return nil
+		}
+		rel, err := filepath.Rel(prebuiltDir, path)
+		if err != nil {
+			return err
+		}
+		outputPath := filepath.Join(cssDir, rel)
+		if err := os.MkdirAll(filepath.Dir(outputPath), 0755); err != nil {
+			return err
+		}
+		copied++
+		return copyFile(path, outputPath)
+	})
+	if err != nil {
+		return err
+	}
+	if copied == 0 {
+		return fmt.Errorf("no css in %s", prebuiltDir)
+	}
+	slog.Info("copied prebuilt css", "from", prebuiltDir, "to", cssDir, "files", copied)
 	return nil
 }
 
-// copy file helper (kept for backwards compatibility if needed)
+// copy file helper
 func copyFile(src, dst string) error {
 	sourceFile, err := os.Open(src)
 	if err != nil {
@@ -0,0 +1,93 @@
+package scss
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"taskbox/internal/watch"
+)
+
+// browsers listening for recompiles in dev mode
+var (
+	subsMu   sync.Mutex
+	subs     = map[chan error]struct{}{}
+	watching bool
+)
+
+// whether a watcher is running to send compile results
+func Watching() bool {
+	subsMu.Lock()
+	defer subsMu.Unlock()
+	return watching
+}
+
+// compile results, nil on success; closed when the watcher stops, or at once when none runs
+func Subscribe() (<-chan error, func()) {
+	ch := make(chan error, 1)
+
+	subsMu.Lock()
+	defer subsMu.Unlock()
+	if !watching {
+		close(ch)
+		return ch, func() {}
+	}
+	subs[ch] = struct{}{}
+
+	return ch, func() {
+		subsMu.Lock()
+		delete(subs, ch)
+		subsMu.Unlock()
+	}
+}
+
+func notify(err error) {
+	subsMu.Lock()
+	defer subsMu.Unlock()
+
+	for ch := range subs {
+		// only the latest result matters to a slow browser
+		select {
+		case <-ch:
+		default:
+		}
+		select {
+		case ch <- err:
+		default:
+		}
+	}
+}
+
+func setWatching(on bool) {
+	subsMu.Lock()
+	defer subsMu.Unlock()
+
+	watching = on
+	if on {
+		return
+	}
+	for ch := range subs {
+		close(ch)
+		delete(subs, ch)
+	}
+}
+
+// watch scss files for changes and recompile with c until ctx is done
+func Watch(ctx context.Context, c Compiler, scssDir, cssDir string) {
+	setWatching(true)
+	defer setWatching(false)
+
+	// initial compilation
+	if err := c.CompileAll(scssDir, cssDir); err != nil {
+		slog.Error("initial scss compilation failed", "err", err)
+	}
+
+	err := watch.Tree(ctx, scssDir, ".scss", func() {
+		if err := c.CompileAll(scssDir, cssDir); err != nil {
+			slog.Error("scss compilation failed", "err", err)
+		}
+	})
+	if err != nil {
+		slog.Error("scss watcher failed", "err", err)
+		<-ctx.Done()
+	}
+}
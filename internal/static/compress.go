@@ -0,0 +1,75 @@
+package static
+
+import (
+	"compress/gzip"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// text files worth compressing ahead of time
+var compressible = []string{".css", ".js", ".svg", ".map", ".json", ".txt"}
+
+// write .br and .gz next to each compressible file under dir, returning how many were compressed
+func Precompress(dir string) (int, error) {
+	count := 0
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !isCompressible(path) {
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		gz := func(w io.Writer) io.WriteCloser {
+			zw, _ := gzip.NewWriterLevel(w, gzip.BestCompression)
+			return zw
+		}
+		if err := writeCompressed(path+".gz", data, gz); err != nil {
+			return err
+		}
+		br := func(w io.Writer) io.WriteCloser {
+			return brotli.NewWriterLevel(w, brotli.BestCompression)
+		}
+		if err := writeCompressed(path+".br", data, br); err != nil {
+			return err
+		}
+		count++
+		return nil
+	})
+	return count, err
+}
+
+func isCompressible(path string) bool {
+	for _, ext := range compressible {
+		if strings.HasSuffix(path, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+func writeCompressed(path string, data []byte, compressor func(io.Writer) io.WriteCloser) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	zw := compressor(f)
+	if _, err := zw.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,216 @@
+package static
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"log/slog"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// hex characters of the content hash put into file names
+const hashLength = 10
+
+// precompressed variants, preferred in this order
+var encodings = []struct {
+	name string
+	ext  string
+}{
+	{"br", ".br"},
+	{"gzip", ".gz"},
+}
+
+// static tree with content-hashed urls cached for a year, css/main.css is linked as css/main.<hash>.css
+type Server struct {
+	fsys fs.FS
+
+	// files on disk change while developing, so entries are checked against mtime and size
+	mutable bool
+
+	// the manifest, logical name to hashed file
+	mu    sync.Mutex
+	files map[string]*file
+}
+
+type file struct {
+	hash     string
+	modTime  time.Time
+	size     int64
+	variants map[string]string // encoding to file name
+}
+
+func New(fsys fs.FS, mutable bool) *Server {
+	return &Server{fsys: fsys, mutable: mutable, files: map[string]*file{}}
+}
+
+// hashed path of a file under the static root, or the name itself when it doesn't exist
+func (s *Server) Path(name string) string {
+	f, err := s.lookup(name)
+	if err != nil {
+		slog.Warn("static file missing", "name", name, "err", err)
+		return name
+	}
+	return hashedName(name, f.hash)
+}
+
+// manifest entry for name, hashed on first use and again after it changes on disk
+func (s *Server) lookup(name string) (*file, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, ok := s.files[name]
+	if ok && !s.mutable {
+		return f, nil
+	}
+
+	info, err := fs.Stat(s.fsys, name)
+	if err != nil {
+		delete(s.files, name)
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, fs.ErrNotExist
+	}
+	if ok && info.ModTime().Equal(f.modTime) && info.Size() == f.size {
+		return f, nil
+	}
+
+	data, err := fs.ReadFile(s.fsys, name)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(data)
+	f = &file{
+		hash:     hex.EncodeToString(sum[:])[:hashLength],
+		modTime:  info.ModTime(),
+		size:     info.Size(),
+		variants: map[string]string{},
+	}
+
+	// a variant older than its source was left over from an earlier build
+	for _, enc := range encodings {
+		vinfo, err := fs.Stat(s.fsys, name+enc.ext)
+		if err == nil && !vinfo.ModTime().Before(info.ModTime()) {
+			f.variants[enc.name] = name + enc.ext
+		}
+	}
+
+	s.files[name] = f
+	return f, nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/")
+	if name == "" || !fs.ValidPath(name) {
+		http.NotFound(w, r)
+		return
+	}
+
+	// css/main.<hash>.css is css/main.css, a stale hash still gets the current file but isn't cached for good
+	logical, hash := splitHash(name)
+	f, err := s.lookup(logical)
+	if err != nil && hash != "" {
+		logical, hash = name, ""
+		f, err = s.lookup(logical)
+	}
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if hash == f.hash {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	if ctype := mime.TypeByExtension(path.Ext(logical)); ctype != "" {
+		w.Header().Set("Content-Type", ctype)
+	}
+
+	served, etag := logical, `"`+f.hash+`"`
+	if len(f.variants) > 0 {
+		w.Header().Add("Vary", "Accept-Encoding")
+		for _, enc := range encodings {
+			if variant, ok := f.variants[enc.name]; ok && accepts(r, enc.name) {
+				w.Header().Set("Content-Encoding", enc.name)
+				served, etag = variant, `"`+f.hash+"-"+enc.name+`"`
+				break
+			}
+		}
+	}
+	w.Header().Set("ETag", etag)
+
+	content, err := s.open(served)
+	if err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	if c, ok := content.(io.Closer); ok {
+		defer c.Close()
+	}
+	http.ServeContent(w, r, "", f.modTime, content)
+}
+
+// a seekable reader for name, files that can't seek are read into memory
+func (s *Server) open(name string) (io.ReadSeeker, error) {
+	file, err := s.fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	if rs, ok := file.(io.ReadSeeker); ok {
+		return rs, nil
+	}
+	defer file.Close()
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(data), nil
+}
+
+// css/main.css with hash abc becomes css/main.abc.css
+func hashedName(name, hash string) string {
+	ext := path.Ext(name)
+	return strings.TrimSuffix(name, ext) + "." + hash + ext
+}
+
+// logical name and hash of css/main.<hash>.css, or name and "" without a hash
+func splitHash(name string) (string, string) {
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	hash := path.Ext(base)
+	if len(hash) != hashLength+1 || !isHex(hash[1:]) {
+		return name, ""
+	}
+	return strings.TrimSuffix(base, hash) + ext, hash[1:]
+}
+
+func isHex(s string) bool {
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// whether the request's Accept-Encoding allows enc
+func accepts(r *http.Request, enc string) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		if !strings.EqualFold(strings.TrimSpace(coding), enc) {
+			continue
+		}
+		q, ok := strings.CutPrefix(strings.TrimSpace(params), "q=")
+		if !ok {
+			return true
+		}
+		weight, err := strconv.ParseFloat(q, 64)
+		return err == nil && weight > 0
+	}
+	return false
+}
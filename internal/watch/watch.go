@@ -0,0 +1,70 @@
+package watch
+
+import (
+	"context"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// editors save in bursts of events, so callbacks wait for the tree to settle
+const debounce = 100 * time.Millisecond
+
+// call changed once files with the extension under root settle after an edit, until ctx is done
+func Tree(ctx context.Context, root, ext string, changed func()) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	// inotify watches aren't recursive, every directory is added on its own
+	addDirs(watcher, root)
+
+	timer := time.NewTimer(debounce)
+	timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if event.Has(fsnotify.Create) {
+				if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+					addDirs(watcher, event.Name)
+					timer.Reset(debounce)
+					continue
+				}
+			}
+			if filepath.Ext(event.Name) == ext {
+				timer.Reset(debounce)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			slog.Warn("file watcher error", "dir", root, "err", err)
+		case <-timer.C:
+			changed()
+		}
+	}
+}
+
+func addDirs(watcher *fsnotify.Watcher, root string) {
+	filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return nil
+		}
+		if err := watcher.Add(path); err != nil {
+			slog.Warn("cannot watch directory", "dir", path, "err", err)
+		}
+		return nil
+	})
+}
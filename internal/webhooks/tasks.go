@@ -0,0 +1,38 @@
+package webhooks
+
+// task lifecycle events, shared by the web ui, caldav and inbound mail
+
+func (d *Dispatcher) TaskCreated(userID int, id int64, title, position string) {
+	d.Publish(userID, TaskCreated, map[string]interface{}{
+		"id":       id,
+		"title":    title,
+		"position": position,
+	})
+}
+
+// a move (completed when it lands in the archive) and/or edited fields; reorders alone aren't announced
+func (d *Dispatcher) TaskChanged(userID, id int, fromPosition, position string, fields []string) {
+	if position != "" && position != fromPosition {
+		event := TaskMoved
+		if position == "archive" {
+			event = TaskCompleted
+		}
+		d.Publish(userID, event, map[string]interface{}{
+			"id":            id,
+			"from_position": fromPosition,
+			"position":      position,
+		})
+	}
+	if len(fields) > 0 {
+		d.Publish(userID, TaskUpdated, map[string]interface{}{
+			"id":     id,
+			"fields": fields,
+		})
+	}
+}
+
+func (d *Dispatcher) TaskDeleted(userID, id int) {
+	d.Publish(userID, TaskDeleted, map[string]interface{}{
+		"id": id,
+	})
+}
@@ -0,0 +1,288 @@
+package webhooks
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"taskbox/internal/metrics"
+	"time"
+)
+
+// event names sent to subscribers
+const (
+	TaskCreated    = "task.created"
+	TaskUpdated    = "task.updated"
+	TaskMoved      = "task.moved"
+	TaskCompleted  = "task.completed"
+	TaskDeleted    = "task.deleted"
+	CommentCreated = "comment.created"
+)
+
+var Events = []string{TaskCreated, TaskUpdated, TaskMoved, TaskCompleted, TaskDeleted, CommentCreated}
+
+const (
+	maxAttempts  = 8
+	batchSize    = 20
+	pollInterval = 5 * time.Second
+	// events published but not yet queued, past this they are dropped
+	maxBacklog = 10000
+)
+
+// queues and sends webhook deliveries
+type Dispatcher struct {
+	db     *sql.DB
+	client *http.Client
+	wake   chan struct{}
+
+	// handed over by Publish, turned into deliveries by the worker
+	mu        sync.Mutex
+	published []published
+}
+
+type published struct {
+	userID  int
+	event   string
+	payload []byte
+}
+
+func NewDispatcher(db *sql.DB) *Dispatcher {
+	return &Dispatcher{
+		db:     db,
+		client: newClient(),
+		wake:   make(chan struct{}, 1),
+	}
+}
+
+// hand an event to the worker, which queues it for every matching webhook of the user; no database work in the caller
+func (d *Dispatcher) Publish(userID int, event string, data interface{}) {
+	payload, err := json.Marshal(map[string]interface{}{
+		"event":      event,
+		"created_at": time.Now().UTC().Format(time.RFC3339),
+		"data":       data,
+	})
+	if err != nil {
+		slog.Error("webhook payload encoding failed", "err", err)
+		return
+	}
+
+	d.mu.Lock()
+	if len(d.published) >= maxBacklog {
+		d.mu.Unlock()
+		slog.Warn("webhook backlog full, event dropped", "event", event, "user_id", userID)
+		return
+	}
+	d.published = append(d.published, published{userID: userID, event: event, payload: payload})
+	d.mu.Unlock()
+	d.notify()
+}
+
+// turn published events into pending deliveries, also called at shutdown once nothing publishes anymore
+func (d *Dispatcher) Flush() {
+	d.mu.Lock()
+	events := d.published
+	d.published = nil
+	d.mu.Unlock()
+
+	for _, e := range events {
+		d.queue(e)
+	}
+}
+
+func (d *Dispatcher) queue(e published) {
+	rows, err := d.db.Query("SELECT id, events FROM webhooks WHERE user_id = ?", e.userID)
+	if err != nil {
+		slog.Error("webhook lookup failed", "err", err)
+		return
+	}
+
+	ids := []int{}
+	for rows.Next() {
+		var id int
+		var events string
+		if err := rows.Scan(&id, &events); err != nil {
+			continue
+		}
+		if Subscribed(events, e.event) {
+			ids = append(ids, id)
+		}
+	}
+	rows.Close()
+
+	for _, id := range ids {
+		_, err := d.db.Exec(
+			"INSERT INTO webhook_deliveries (webhook_id, event, payload) VALUES (?, ?, ?)",
+			id, e.event, string(e.payload),
+		)
+		if err != nil {
+			slog.Error("webhook delivery queue failed", "err", err)
+		}
+	}
+}
+
+// queue a fresh copy of an earlier delivery
+func (d *Dispatcher) Redeliver(userID, deliveryID int) error {
+	result, err := d.db.Exec(`
+		INSERT INTO webhook_deliveries (webhook_id, event, payload)
+		SELECT d.webhook_id, d.event, d.payload
+		FROM webhook_deliveries d
+		JOIN webhooks w ON w.id = d.webhook_id
+		WHERE d.id = ? AND w.user_id = ?
+	`, deliveryID, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	d.notify()
+	return nil
+}
+
+// send due deliveries until ctx is cancelled
+func (d *Dispatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		d.Flush()
+		d.sendDue(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-d.wake:
+		}
+	}
+}
+
+func (d *Dispatcher) notify() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+type delivery struct {
+	id       int
+	event    string
+	payload  string
+	attempts int
+	url      string
+	secret   string
+}
+
+func (d *Dispatcher) sendDue(ctx context.Context) {
+	rows, err := d.db.Query(`
+		SELECT d.id, d.event, d.payload, d.attempts, w.url, w.secret
+		FROM webhook_deliveries d
+		JOIN webhooks w ON w.id = d.webhook_id
+		WHERE d.status = 'pending' AND d.next_attempt_at <= CURRENT_TIMESTAMP
+		ORDER BY d.id
+		LIMIT ?
+	`, batchSize)
+	if err != nil {
+		slog.Error("webhook delivery lookup failed", "err", err)
+		return
+	}
+
+	due := []delivery{}
+	for rows.Next() {
+		var dl delivery
+		if err := rows.Scan(&dl.id, &dl.event, &dl.payload, &dl.attempts, &dl.url, &dl.secret); err != nil {
+			continue
+		}
+		due = append(due, dl)
+	}
+	rows.Close()
+
+	for _, dl := range due {
+		if ctx.Err() != nil {
+			return
+		}
+		d.send(ctx, dl)
+	}
+}
+
+func (d *Dispatcher) send(ctx context.Context, dl delivery) {
+	code, err := d.post(ctx, dl)
+	attempts := dl.attempts + 1
+
+	if err == nil {
+		metrics.Job("webhook_delivery", "ok")
+		d.db.Exec(`
+			UPDATE webhook_deliveries
+			SET status = 'success', attempts = ?, response_code = ?, error = NULL, delivered_at = CURRENT_TIMESTAMP
+			WHERE id = ?
+		`, attempts, code, dl.id)
+		return
+	}
+
+	if attempts >= maxAttempts {
+		metrics.Job("webhook_delivery", "failed")
+		d.db.Exec(`
+			UPDATE webhook_deliveries
+			SET status = 'failed', attempts = ?, response_code = ?, error = ?
+			WHERE id = ?
+		`, attempts, code, err.Error(), dl.id)
+		return
+	}
+
+	// exponential backoff: 30s, 1m, 2m, 4m, ...
+	metrics.Job("webhook_delivery", "retry")
+	backoff := 30 << (attempts - 1)
+	d.db.Exec(`
+		UPDATE webhook_deliveries
+		SET attempts = ?, response_code = ?, error = ?, next_attempt_at = datetime('now', '+' || ? || ' seconds')
+		WHERE id = ?
+	`, attempts, code, err.Error(), backoff, dl.id)
+}
+
+func (d *Dispatcher) post(ctx context.Context, dl delivery) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", dl.url, strings.NewReader(dl.payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Gridwork-Webhooks")
+	req.Header.Set("X-Gridwork-Event", dl.event)
+	req.Header.Set("X-Gridwork-Delivery", fmt.Sprint(dl.id))
+	req.Header.Set("X-Gridwork-Signature", "sha256="+Sign(dl.secret, []byte(dl.payload)))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// hex hmac-sha256 of the body, receivers recompute it with their secret
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// check a comma separated subscription list against an event
+func Subscribed(events, event string) bool {
+	for _, e := range strings.Split(events, ",") {
+		if e = strings.TrimSpace(e); e == "*" || e == event {
+			return true
+		}
+	}
+	return false
+}
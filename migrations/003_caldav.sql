@@ -0,0 +1,5 @@
+-- icalendar identity for tasks created or synced over caldav
+ALTER TABLE tasks ADD COLUMN ical_uid TEXT;
+ALTER TABLE tasks ADD COLUMN dav_name TEXT;
+
+CREATE INDEX IF NOT EXISTS idx_tasks_user_dav_name ON tasks(user_id, dav_name);
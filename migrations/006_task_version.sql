@@ -0,0 +1,2 @@
+-- optimistic concurrency, bumped on every task write
+ALTER TABLE tasks ADD COLUMN version INTEGER NOT NULL DEFAULT 1;
@@ -0,0 +1,3 @@
+-- administrators and disabled accounts
+ALTER TABLE users ADD COLUMN is_admin INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE users ADD COLUMN disabled_at DATETIME;
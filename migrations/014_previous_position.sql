@@ -0,0 +1,2 @@
+-- where a task was before it was archived, so reopening it puts it back
+ALTER TABLE tasks ADD COLUMN previous_position TEXT;